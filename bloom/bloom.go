@@ -1,84 +1,150 @@
 package bloom
 
 import (
-	"encoding/binary"
-	"math/bits"
+	"fmt"
+	"math"
 )
 
-// TODO: Implement Hash interface
-func murmurhash3(data []byte, seed uint32) uint32 {
-
-	var c1 uint32 = 0xcc9e2d51
-	var c2 uint32 = 0x1b873593
-	r1 := 15
-	r2 := 13
-	var m uint32 = 5
-	var n uint32 = 0xe6546b64
-	var h = seed
-
-	numChunks := len(data) / 4
-	i := 0
-	for ; i < numChunks*4; i += 4 {
-		k := binary.LittleEndian.Uint32(data[i:])
-		k *= c1
-		k = bits.RotateLeft32(k, r1)
-		k *= c2
-		h ^= k
-		h = bits.RotateLeft32(h, r2)
-		h = h*m + n
+// Size is the filter size in bytes used before filters were sized from
+// their entry count, and by a zero Filter.
+const Size = 128 // bytes
+const kFunctions = 7
+
+// DefaultFalsePositiveRate is the false positive rate filters are sized for
+// when none is given.
+const DefaultFalsePositiveRate = 0.01
+
+const maxHashes = 30
+
+// encodingVersion is the first byte of a marshaled filter. Version 1
+// filters have no hash byte and use LegacyMurmur3.
+const encodingVersion = 2
+
+// KeyFilter is a set of keys that may report false positives, but never
+// false negatives.
+type KeyFilter interface {
+	Insert(key string)
+	Search(key string) bool
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(data []byte) error
+}
+
+type Filter struct {
+	Buf []byte
+	// Hashes is the number of bits set per key. Zero means kFunctions.
+	Hashes int
+	Hash   Hash
+}
+
+// New returns a filter sized to hold n keys with the given false positive
+// rate.
+func New(n int, fpRate float64) *Filter {
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultFalsePositiveRate
 	}
+	n = max(n, 1)
 
-	var k uint32
-	tail := data[i:]
-	switch len(tail) & 3 {
-	case 3:
-		k ^= uint32(tail[2]) << 16
-		fallthrough
-	case 2:
-		k ^= uint32(tail[1]) << 8
-		fallthrough
-	case 1:
-		k ^= uint32(tail[0])
-		k *= c1
-		k = bits.RotateLeft32(k, r1)
-		k *= c2
-		h ^= k
+	// The optimal filter has m = -n ln(p) / ln(2)^2 bits and sets
+	// k = m/n ln(2) bits per key.
+	bitsPerKey := -math.Log(fpRate) / (math.Ln2 * math.Ln2)
+	size := int(math.Ceil(float64(n) * bitsPerKey / 8))
+	hashes := int(math.Round(bitsPerKey * math.Ln2))
+	return &Filter{
+		Buf:    make([]byte, max(size, 8)),
+		Hashes: min(max(hashes, 1), maxHashes),
+		Hash:   DefaultHash,
 	}
+}
 
-	h ^= uint32(len(data))
-	h ^= (h >> 16)
-	h *= 0x85ebca6b
-	h ^= (h >> 13)
-	h *= 0xc2b2ae35
-	h ^= (h >> 16)
-	return h
+func (f *Filter) hashes() int {
+	if f.Hashes == 0 {
+		return kFunctions
+	}
+	return f.Hashes
 }
 
-// TODO: Make configurable/optimize based on segment sizes.
-const Size = 128 // bytes
-const kFunctions = 7
+// forEachBit calls fn with the index of each bit key maps to, stopping
+// early if fn returns false.
+func (f *Filter) forEachBit(key string, fn func(bitIdx uint32) bool) {
+	bitCount := uint32(len(f.Buf) * 8)
+	if f.Hash == LegacyMurmur3 {
+		for i := range f.hashes() {
+			if !fn(murmurhash3([]byte(key), uint32(i)) % bitCount) {
+				return
+			}
+		}
+		return
+	}
 
-type Filter struct {
-	Buf [Size]byte
+	h1, h2 := f.Hash.doubleHash([]byte(key))
+	for i := range f.hashes() {
+		if !fn((h1 + uint32(i)*h2) % bitCount) {
+			return
+		}
+	}
 }
 
 func (f *Filter) Insert(key string) {
-	for i := range kFunctions {
-		h := murmurhash3([]byte(key), uint32(i))
-		bitIdx := h % (Size * 8)
+	if len(f.Buf) == 0 {
+		f.Buf = make([]byte, Size)
+	}
+	f.forEachBit(key, func(bitIdx uint32) bool {
 		byteIdx, bitShift := bitIdx/8, 7-bitIdx%8
 		f.Buf[byteIdx] |= 1 << byte(bitShift)
-	}
+		return true
+	})
 }
 
 func (f *Filter) Search(key string) bool {
-	for i := range kFunctions {
-		h := murmurhash3([]byte(key), uint32(i))
-		bitIdx := h % (Size * 8)
+	if len(f.Buf) == 0 {
+		return false
+	}
+	found := true
+	f.forEachBit(key, func(bitIdx uint32) bool {
 		byteIdx, bitShift := bitIdx/8, 7-bitIdx%8
-		if f.Buf[byteIdx]&(1<<byte(bitShift)) == 0 {
-			return false
+		found = f.Buf[byteIdx]&(1<<byte(bitShift)) != 0
+		return found
+	})
+	return found
+}
+
+// MarshalBinary encodes the filter along with its parameters.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 3+len(f.Buf))
+	data = append(data, encodingVersion, byte(f.Hash), byte(f.hashes()))
+	return append(data, f.Buf...), nil
+}
+
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("Not enough data to decode filter")
+	}
+	hash := LegacyMurmur3
+	switch data[0] {
+	case 1:
+		data = data[1:]
+	case encodingVersion:
+		if len(data) < 2 {
+			return fmt.Errorf("Not enough data to decode filter")
 		}
+		hash = Hash(data[1])
+		if _, ok := hashNames[hash]; !ok {
+			return fmt.Errorf("Unknown filter hash %d", hash)
+		}
+		data = data[2:]
+	default:
+		return fmt.Errorf("Could not decode filter with version %d", data[0])
+	}
+
+	if len(data) < 2 {
+		return fmt.Errorf("Not enough data to decode filter")
+	}
+	hashes := int(data[0])
+	if hashes < 1 || hashes > maxHashes {
+		return fmt.Errorf("Invalid filter hash count %d", hashes)
 	}
-	return true
+	f.Hashes = hashes
+	f.Hash = hash
+	f.Buf = append([]byte(nil), data[1:]...)
+	return nil
 }
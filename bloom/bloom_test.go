@@ -1,6 +1,9 @@
 package bloom
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestMurmur32(t *testing.T) {
 
@@ -51,3 +54,155 @@ func TestBloom(t *testing.T) {
 	}
 
 }
+
+func TestZeroBlockedFilter(t *testing.T) {
+	filter := BlockedFilter{}
+
+	if filter.Search("hello") {
+		t.Error("Did not expect to find 'hello' in an empty filter")
+	}
+
+	filter.Insert("hello")
+	if !filter.Search("hello") {
+		t.Error("Expected to find 'hello' in filter, but could not")
+	}
+	if len(filter.Buf) != blockBytes {
+		t.Errorf("Expected a single block, got %d bytes", len(filter.Buf))
+	}
+}
+
+func TestSizedFalsePositiveRate(t *testing.T) {
+	const n = 10000
+	for _, hash := range []Hash{Murmur3, XXHash64} {
+		filter := New(n, 0.01)
+		filter.Hash = hash
+		for i := range n {
+			filter.Insert(fmt.Sprintf("key%d", i))
+		}
+
+		for i := range n {
+			if !filter.Search(fmt.Sprintf("key%d", i)) {
+				t.Fatalf("Expected to find key%d in %s filter, but could not", i, hash)
+			}
+		}
+
+		falsePositives := 0
+		for i := range n {
+			if filter.Search(fmt.Sprintf("other%d", i)) {
+				falsePositives++
+			}
+		}
+		if rate := float64(falsePositives) / n; rate > 0.02 {
+			t.Errorf("False positive rate %f is too high for 0.01 %s filter", rate, hash)
+		}
+	}
+}
+
+func TestMarshalFilter(t *testing.T) {
+	filter := New(100, 0.001)
+	filter.Insert("hello")
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := Filter{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hashes != filter.Hashes || len(decoded.Buf) != len(filter.Buf) {
+		t.Errorf("Decoded filter has %d hashes and %d bytes (expected %d and %d)",
+			decoded.Hashes, len(decoded.Buf), filter.Hashes, len(filter.Buf))
+	}
+	if !decoded.Search("hello") {
+		t.Error("Expected to find 'hello' in decoded filter, but could not")
+	}
+}
+
+func TestUnmarshalVersion1Filter(t *testing.T) {
+	legacy := Filter{}
+	legacy.Insert("hello")
+	data := append([]byte{1, kFunctions}, legacy.Buf...)
+
+	decoded := Filter{}
+	err := decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hash != LegacyMurmur3 {
+		t.Errorf("Decoded version 1 filter with hash %s", decoded.Hash)
+	}
+	if !decoded.Search("hello") {
+		t.Error("Expected to find 'hello' in decoded filter, but could not")
+	}
+}
+
+func TestBlockedFalsePositiveRate(t *testing.T) {
+	const n = 10000
+	filter := NewBlocked(n, 0.01)
+	for i := range n {
+		filter.Insert(fmt.Sprintf("key%d", i))
+	}
+
+	for i := range n {
+		if !filter.Search(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("Expected to find key%d in filter, but could not", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := range n {
+		if filter.Search(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.025 {
+		t.Errorf("False positive rate %f is too high for 0.01 blocked filter", rate)
+	}
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := BlockedFilter{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Search("key0") {
+		t.Error("Expected to find key0 in decoded filter, but could not")
+	}
+}
+
+func benchmarkSearch(b *testing.B, filter KeyFilter) {
+	const n = 100000
+	for i := range n {
+		filter.Insert(fmt.Sprintf("key%d", i))
+	}
+	missing := make([]string, n)
+	for i := range missing {
+		missing[i] = fmt.Sprintf("other%d", i)
+	}
+
+	b.ResetTimer()
+	falsePositives := 0
+	for i := 0; i < b.N; i++ {
+		if filter.Search(missing[i%n]) {
+			falsePositives++
+		}
+	}
+	b.ReportMetric(float64(falsePositives)/float64(b.N), "fp/op")
+}
+
+func BenchmarkSearch(b *testing.B) {
+	b.Run("Legacy", func(b *testing.B) {
+		benchmarkSearch(b, &Filter{})
+	})
+	b.Run("Filter", func(b *testing.B) {
+		benchmarkSearch(b, New(100000, 0.01))
+	})
+	b.Run("Blocked", func(b *testing.B) {
+		benchmarkSearch(b, NewBlocked(100000, 0.01))
+	})
+}
@@ -0,0 +1,252 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/bits"
+)
+
+// Hash identifies the hash function a filter uses. It is recorded in
+// marshaled filters, so the values must never change.
+type Hash uint8
+
+const (
+	// LegacyMurmur3 computes a separately seeded murmur3 hash for each bit,
+	// as filters did before double hashing. A zero Filter uses it.
+	LegacyMurmur3 Hash = 0
+	Murmur3       Hash = 1
+	XXHash64      Hash = 2
+)
+
+// DefaultHash is the hash New uses.
+const DefaultHash = Murmur3
+
+var hashNames = map[Hash]string{
+	LegacyMurmur3: "legacy-murmur3",
+	Murmur3:       "murmur3",
+	XXHash64:      "xxhash64",
+}
+
+func (h Hash) String() string {
+	if name, ok := hashNames[h]; ok {
+		return name
+	}
+	return fmt.Sprintf("Hash(%d)", int(h))
+}
+
+func ParseHash(name string) (Hash, error) {
+	for h, hashName := range hashNames {
+		if name == hashName {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown hash %s", name)
+}
+
+// New returns a hash.Hash32 or hash.Hash64 computing h, seeded as filters
+// seed it.
+func (h Hash) New() hash.Hash {
+	switch h {
+	case XXHash64:
+		return NewXXHash64(0)
+	default:
+		return NewMurmur3(0)
+	}
+}
+
+// doubleHash returns the two hashes of key that a filter combines to pick
+// its bits, as in Kirsch and Mitzenmacher's "Less Hashing, Same
+// Performance". A 64-bit hash gives both halves; a 32-bit hash is paired
+// with a rotation of itself. It gives the same result as hashing through
+// h.New(), but calls the hash functions directly, since filters hash on
+// every probe and going through hash.Hash would allocate each time.
+func (h Hash) doubleHash(key []byte) (uint32, uint32) {
+	switch h {
+	case XXHash64:
+		return splitHash64(xxhash64(key, 0))
+	default:
+		return splitHash32(murmurhash3(key, 0))
+	}
+}
+
+func splitHash64(sum uint64) (uint32, uint32) {
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func splitHash32(sum uint32) (uint32, uint32) {
+	return sum, bits.RotateLeft32(sum, 15)
+}
+
+// bufferedHash adapts a function of the whole input to hash.Hash.
+type bufferedHash struct {
+	buf []byte
+}
+
+func (b *bufferedHash) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *bufferedHash) Reset() {
+	b.buf = b.buf[:0]
+}
+
+type murmur3Hash struct {
+	bufferedHash
+	seed uint32
+}
+
+// NewMurmur3 returns a 32-bit murmur3 hash with the given seed.
+func NewMurmur3(seed uint32) hash.Hash32 {
+	return &murmur3Hash{seed: seed}
+}
+
+func (m *murmur3Hash) Sum32() uint32 {
+	return murmurhash3(m.buf, m.seed)
+}
+
+func (m *murmur3Hash) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, m.Sum32())
+}
+
+func (m *murmur3Hash) Size() int      { return 4 }
+func (m *murmur3Hash) BlockSize() int { return 4 }
+
+type xxhash64Hash struct {
+	bufferedHash
+	seed uint64
+}
+
+// NewXXHash64 returns a 64-bit xxHash with the given seed.
+func NewXXHash64(seed uint64) hash.Hash64 {
+	return &xxhash64Hash{seed: seed}
+}
+
+func (x *xxhash64Hash) Sum64() uint64 {
+	return xxhash64(x.buf, x.seed)
+}
+
+func (x *xxhash64Hash) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, x.Sum64())
+}
+
+func (x *xxhash64Hash) Size() int      { return 8 }
+func (x *xxhash64Hash) BlockSize() int { return 32 }
+
+func murmurhash3(data []byte, seed uint32) uint32 {
+
+	var c1 uint32 = 0xcc9e2d51
+	var c2 uint32 = 0x1b873593
+	r1 := 15
+	r2 := 13
+	var m uint32 = 5
+	var n uint32 = 0xe6546b64
+	var h = seed
+
+	numChunks := len(data) / 4
+	i := 0
+	for ; i < numChunks*4; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= c1
+		k = bits.RotateLeft32(k, r1)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, r2)
+		h = h*m + n
+	}
+
+	var k uint32
+	tail := data[i:]
+	switch len(tail) & 3 {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, r1)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= (h >> 16)
+	h *= 0x85ebca6b
+	h ^= (h >> 13)
+	h *= 0xc2b2ae35
+	h ^= (h >> 16)
+	return h
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc uint64, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc uint64, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func xxhash64(data []byte, seed uint64) uint64 {
+	var h uint64
+	n := len(data)
+
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:]))
+			data = data[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint64(n)
+
+	for len(data) >= 8 {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+		data = data[8:]
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
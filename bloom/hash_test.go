@@ -0,0 +1,78 @@
+package bloom
+
+import (
+	"hash"
+	"testing"
+)
+
+func TestXXHash64(t *testing.T) {
+	var data = []struct {
+		seed uint64
+		h64  uint64
+		data string
+	}{
+		{0, 0xef46db3751d8e999, ""},
+		{0, 0x44bc2cf5ad770999, "abc"},
+		{0, 0x0b242d361fda71bc, "The quick brown fox jumps over the lazy dog"},
+	}
+
+	for _, entry := range data {
+		res := xxhash64([]byte(entry.data), entry.seed)
+
+		if res != entry.h64 {
+			t.Errorf("Got unexpected hash for %s (got %x, expected %x)", entry.data, res, entry.h64)
+		}
+	}
+}
+
+func TestHashInterface(t *testing.T) {
+	key := "The quick brown fox jumps over the lazy dog."
+
+	// Writing in pieces must match hashing the whole key.
+	var h32 hash.Hash32 = NewMurmur3(0x2a)
+	h32.Write([]byte(key[:10]))
+	h32.Write([]byte(key[10:]))
+	if h32.Sum32() != 0xc02d1434 {
+		t.Errorf("Got unexpected murmur3 hash %x", h32.Sum32())
+	}
+
+	var h64 hash.Hash64 = NewXXHash64(0)
+	h64.Write([]byte("ab"))
+	h64.Write([]byte("c"))
+	if h64.Sum64() != 0x44bc2cf5ad770999 {
+		t.Errorf("Got unexpected xxhash64 hash %x", h64.Sum64())
+	}
+	if len(h64.Sum(nil)) != h64.Size() {
+		t.Errorf("Sum has %d bytes (expected %d)", len(h64.Sum(nil)), h64.Size())
+	}
+
+	h64.Reset()
+	if h64.Sum64() != 0xef46db3751d8e999 {
+		t.Errorf("Got unexpected xxhash64 hash %x after reset", h64.Sum64())
+	}
+
+	// Filters must pick the same bits as hashing through the interface.
+	for _, h := range []Hash{Murmur3, XXHash64} {
+		h1, h2 := h.doubleHash([]byte(key))
+		i1, i2 := hasherDoubleHash(t, h.New(), []byte(key))
+		if h1 != i1 || h2 != i2 {
+			t.Errorf("Got double hash %x, %x for %s (expected %x, %x)", h1, h2, h, i1, i2)
+		}
+	}
+}
+
+// hasherDoubleHash splits a sum from hasher as doubleHash splits the hash
+// it computes directly.
+func hasherDoubleHash(t *testing.T, hasher hash.Hash, key []byte) (uint32, uint32) {
+	t.Helper()
+	hasher.Reset()
+	hasher.Write(key)
+	switch hasher := hasher.(type) {
+	case hash.Hash64:
+		return splitHash64(hasher.Sum64())
+	case hash.Hash32:
+		return splitHash32(hasher.Sum32())
+	}
+	t.Fatalf("Hash %T is neither a hash.Hash32 nor a hash.Hash64", hasher)
+	return 0, 0
+}
@@ -0,0 +1,109 @@
+package lsm
+
+import (
+	"bigsby/storage"
+	"encoding/binary"
+	"fmt"
+)
+
+// WriteBatch collects writes for Write to apply together. The zero value is
+// an empty batch.
+type WriteBatch struct {
+	entries []storage.EntryData
+}
+
+func (b *WriteBatch) Put(key KeyType, value ValueType) {
+	b.entries = append(b.entries, storage.EntryData{Key: key, Value: value})
+}
+
+func (b *WriteBatch) Delete(key KeyType) {
+	b.entries = append(b.entries, storage.EntryData{Key: key, Kind: storage.KindDelete})
+}
+
+// Merge adds a merge operand for key. See LSMTree.Merge.
+func (b *WriteBatch) Merge(key KeyType, operand string) {
+	b.entries = append(b.entries, storage.EntryData{Key: key, Value: operand, Kind: storage.KindMerge})
+}
+
+// DeleteRange deletes every key in [start, end). An empty end means there
+// is no upper bound.
+func (b *WriteBatch) DeleteRange(start KeyType, end KeyType) {
+	b.entries = append(b.entries, storage.EntryData{Key: start, Value: end, Kind: storage.KindRangeDelete})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// encodeBatchRecord encodes entries as a single log record: the entry count
+// followed by each entry.
+func encodeBatchRecord(entries []storage.EntryData) []byte {
+	record := []byte{logRecordBatch}
+	record = binary.BigEndian.AppendUint32(record, uint32(len(entries)))
+	for _, entry := range entries {
+		record = append(record, storage.EncodeEntry(entry)...)
+	}
+	return record
+}
+
+// decodeBatchRecord decodes a batch record, after its type byte, decoding
+// each entry with decode. Nothing is returned unless the whole batch decodes.
+func decodeBatchRecord(data []byte, decode func([]byte) (*storage.EntryData, int, error)) ([]storage.EntryData, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("Not enough data to decode batch")
+	}
+	count := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	entries := make([]storage.EntryData, 0, min(count, len(data)))
+	for range count {
+		entry, read, err := decode(data)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+		data = data[read:]
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("Unexpected data after batch")
+	}
+	return entries, nil
+}
+
+// Write applies every write in the batch, or none of them. The batch is
+// logged as one record, and readers and snapshots see either all of its
+// writes or none. The batch may be reused once Write returns.
+func (t *LSMTree) Write(batch *WriteBatch) error {
+	return t.write(batch, nil)
+}
+
+func (t *LSMTree) write(batch *WriteBatch, validate func() error) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	for _, entry := range batch.entries {
+		if entry.Kind == storage.KindRangeDelete && entry.Value != "" && entry.Value <= entry.Key {
+			return fmt.Errorf("Invalid range deletion [%s, %s)", entry.Key, entry.Value)
+		}
+		if entry.Kind == storage.KindMerge && t.settings.MergeOperator == nil {
+			return fmt.Errorf("Cannot merge into key %s without a merge operator", entry.Key)
+		}
+	}
+	logPos, err := t.writeLocked(batch.entries, validate)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the log outside the lock, so other writers can queue up
+	// behind the same sync.
+	err = t.log.WaitSync(logPos)
+	if err != nil {
+		return fmt.Errorf("Error writing to log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Insert("gone", "soon")
+	before := tree.Snapshot()
+	defer before.Release()
+
+	batch := &WriteBatch{}
+	for i := range 5 {
+		batch.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	batch.Put("key0", "overwritten")
+	batch.Delete("gone")
+	err = tree.Write(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.Reset()
+	if batch.Len() != 0 {
+		t.Errorf("Batch has %d writes after reset", batch.Len())
+	}
+
+	check := func(tree *LSMTree) {
+		t.Helper()
+		for i := 1; i < 5; i++ {
+			valPtr, err := tree.Search(fmt.Sprintf("key%d", i))
+			if err != nil || valPtr == nil || *valPtr != fmt.Sprintf("value%d", i) {
+				t.Errorf("Got %v, %v for key%d", valPtr, err, i)
+			}
+		}
+		valPtr, err := tree.Search("key0")
+		if err != nil || valPtr == nil || *valPtr != "overwritten" {
+			t.Errorf("Got %v, %v for key0 (expected the last write)", valPtr, err)
+		}
+		valPtr, err = tree.Search("gone")
+		if err != nil || valPtr != nil {
+			t.Errorf("Got %v, %v for deleted key", valPtr, err)
+		}
+	}
+	check(tree)
+
+	// Snapshots from before the batch see none of it.
+	valPtr, err := before.Search("gone")
+	if err != nil || valPtr == nil || *valPtr != "soon" {
+		t.Errorf("Got %v, %v for gone in snapshot", valPtr, err)
+	}
+	valPtr, err = before.Search("key3")
+	if err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v for key3 in snapshot", valPtr, err)
+	}
+
+	// The batch is recovered from the log as a whole.
+	tree.Close()
+	tree, err = New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check(tree)
+}
+
+func TestTornWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Insert("before", "batch")
+	batch := &WriteBatch{}
+	for i := range 5 {
+		batch.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	err = tree.Write(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Close()
+
+	// Cut the batch record short, as a crash part way through writing it
+	// would.
+	logFiles, err := filepath.Glob(filepath.Join(getLogDirectory(dir), "*"))
+	if err != nil || len(logFiles) < 2 {
+		t.Fatalf("Could not find log files: %v", err)
+	}
+	// The newest file is the one prepared for the next rotation.
+	lastLog := logFiles[len(logFiles)-2]
+	info, err := os.Stat(lastLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(lastLog, info.Size()-10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	valPtr, err := tree.Search("before")
+	if err != nil || valPtr == nil || *valPtr != "batch" {
+		t.Errorf("Got %v, %v for the write before the batch", valPtr, err)
+	}
+	for i := range 5 {
+		valPtr, err := tree.Search(fmt.Sprintf("key%d", i))
+		if err != nil || valPtr != nil {
+			t.Errorf("Got %v, %v for key%d of a torn batch", valPtr, err, i)
+		}
+	}
+}
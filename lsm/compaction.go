@@ -0,0 +1,280 @@
+package lsm
+
+import (
+	"bigsby/sstable"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// CompactionStrategy decides which segments to merge next.
+type CompactionStrategy interface {
+	// PickCompaction returns the next compaction to run, or nil if none is
+	// needed. Segments in each level are ordered oldest first.
+	PickCompaction(levels [][]*sstable.Table) *Compaction
+}
+
+// LevelRange is the contiguous run of segments [Start, End) in a level.
+type LevelRange struct {
+	Level int
+	Start int
+	End   int
+}
+
+// Compaction merges its input ranges into a single segment, which takes the
+// place of the input range in OutputLevel. OutputLevel must be one of the
+// input levels, though its range may be empty.
+type Compaction struct {
+	Inputs      []LevelRange
+	OutputLevel int
+}
+
+func (c *Compaction) inputCount() int {
+	count := 0
+	for _, r := range c.Inputs {
+		count += r.End - r.Start
+	}
+	return count
+}
+
+func levelSize(segments []*sstable.Table) int64 {
+	var size int64
+	for _, segment := range segments {
+		size += segment.Size()
+	}
+	return size
+}
+
+// LeveledCompaction keeps every level below 0 as a single sorted run. Level 0
+// holds freshly flushed segments, which may overlap, and is merged into level
+// 1 once it has more than LevelZeroMaxSegments of them. Level 1 may hold
+// LevelOneMaxSize bytes and each deeper level may grow LevelSizeRatio times
+// larger than the one above it before it is merged down.
+type LeveledCompaction struct {
+	LevelZeroMaxSegments int
+	LevelOneMaxSize      int
+	LevelSizeRatio       int
+}
+
+const defaultLevelZeroMaxSegments = 4
+const defaultLevelSizeRatio = 10
+const minLevelOneMaxSize = 64 << 10
+
+// maxLevelSize returns the size in bytes above which a level (> 0) is
+// compacted into the next one.
+func (c *LeveledCompaction) maxLevelSize(level int) int64 {
+	size := int64(c.LevelOneMaxSize)
+	for range level - 1 {
+		if size > math.MaxInt64/int64(c.LevelSizeRatio) {
+			return math.MaxInt64
+		}
+		size *= int64(c.LevelSizeRatio)
+	}
+	return size
+}
+
+func (c *LeveledCompaction) PickCompaction(levels [][]*sstable.Table) *Compaction {
+	level := -1
+	if len(levels) > 0 && len(levels[0]) > c.LevelZeroMaxSegments {
+		level = 0
+	}
+	for l := 1; level < 0 && l < len(levels); l++ {
+		size := levelSize(levels[l])
+		if size <= c.maxLevelSize(l) {
+			continue
+		}
+		// Moving the bottom level into an empty one below only rewrites
+		// it, so it is only worth doing once the level below can hold it.
+		// Otherwise an oversized bottom level would be pushed down forever.
+		bottom := true
+		for _, deeper := range levels[l+1:] {
+			bottom = bottom && len(deeper) == 0
+		}
+		if bottom && size > c.maxLevelSize(l+1) {
+			continue
+		}
+		level = l
+	}
+	if level < 0 {
+		return nil
+	}
+
+	// Merge everything in the level into the run in the level below.
+	output := LevelRange{Level: level + 1}
+	if output.Level < len(levels) {
+		output.End = len(levels[output.Level])
+	}
+	return &Compaction{
+		Inputs:      []LevelRange{{Level: level, End: len(levels[level])}, output},
+		OutputLevel: output.Level,
+	}
+}
+
+// SizeTieredCompaction keeps all segments in level 0 and merges runs of
+// similarly sized neighbours, so that each byte is rewritten roughly once per
+// tier rather than once per level. Segments are grouped while their size is
+// within [BucketLow, BucketHigh] times the group's average, and a group is
+// merged once it has MinThreshold segments (at most MaxThreshold at a time).
+// Only adjacent segments are grouped, since merging around a newer segment
+// would let older values shadow it.
+type SizeTieredCompaction struct {
+	MinThreshold int
+	MaxThreshold int
+	BucketLow    float64
+	BucketHigh   float64
+}
+
+func NewSizeTieredCompaction() *SizeTieredCompaction {
+	return &SizeTieredCompaction{
+		MinThreshold: 4,
+		MaxThreshold: 32,
+		BucketLow:    0.5,
+		BucketHigh:   1.5,
+	}
+}
+
+func (c *SizeTieredCompaction) PickCompaction(levels [][]*sstable.Table) *Compaction {
+	if len(levels) == 0 {
+		return nil
+	}
+	segments := levels[0]
+	// Merging a single segment would only rewrite it.
+	minThreshold := max(c.MinThreshold, 2)
+	maxThreshold := max(c.MaxThreshold, minThreshold)
+
+	var best *LevelRange
+	var bestAverage float64
+	start, total := 0, int64(0)
+	for i := 0; i <= len(segments); i++ {
+		if i < len(segments) && i > start {
+			average := float64(total) / float64(i-start)
+			size := float64(segments[i].Size())
+			if size >= average*c.BucketLow && size <= average*c.BucketHigh && i-start < maxThreshold {
+				total += segments[i].Size()
+				continue
+			}
+		}
+
+		// Segment i does not fit the current bucket, so close it out. The
+		// bucket with the smallest segments is the cheapest to merge.
+		if i-start >= minThreshold {
+			average := float64(total) / float64(i-start)
+			if best == nil || average < bestAverage {
+				best = &LevelRange{Level: 0, Start: start, End: i}
+				bestAverage = average
+			}
+		}
+		if i < len(segments) {
+			start, total = i, segments[i].Size()
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	return &Compaction{Inputs: []LevelRange{*best}, OutputLevel: 0}
+}
+
+// compact runs compactions until the strategy has nothing left to merge.
+// Must be called with compactMu held.
+func (t *LSMTree) compact() error {
+	for {
+		t.mu.RLock()
+		compaction := t.settings.CompactionStrategy.PickCompaction(t.segments)
+		t.mu.RUnlock()
+		if compaction == nil || compaction.inputCount() == 0 {
+			return nil
+		}
+
+		err := t.runCompaction(compaction)
+		if err != nil {
+			return fmt.Errorf("Error compacting into level %d: %w", compaction.OutputLevel, err)
+		}
+	}
+}
+
+// runCompaction merges the compaction's inputs without holding mu, then
+// swaps in the merged segment. Flushes may append to level 0 in the
+// meantime, which leaves the input ranges where they were.
+func (t *LSMTree) runCompaction(c *Compaction) error {
+	t.mu.Lock()
+	for len(t.segments) <= c.OutputLevel {
+		t.segments = append(t.segments, make([]*sstable.Table, 0))
+	}
+
+	// Order inputs newest first: later segments in a level are newer, and
+	// shallower levels are newer than deeper ones.
+	inputRanges := make([]*LevelRange, len(t.segments))
+	for i := range c.Inputs {
+		inputRanges[c.Inputs[i].Level] = &c.Inputs[i]
+	}
+	inputs := make([]*sstable.Table, 0)
+	for _, r := range inputRanges {
+		if r == nil {
+			continue
+		}
+		for i := r.End - 1; i >= r.Start; i-- {
+			inputs = append(inputs, t.segments[r.Level][i])
+		}
+	}
+	// Tombstones can only be dropped when no segment older than the inputs
+	// could still hold a value for the key.
+	shallowest, deepest := c.Inputs[0].Level, c.Inputs[0].Level
+	for _, r := range c.Inputs {
+		shallowest, deepest = min(shallowest, r.Level), max(deepest, r.Level)
+	}
+	last := true
+	for level, segments := range t.segments {
+		r := inputRanges[level]
+		if level < shallowest || len(segments) == 0 {
+			continue
+		}
+		if r == nil || r.Start > 0 || (level > shallowest && r.End < len(segments)) {
+			last = false
+		}
+	}
+	opts := t.settings.segmentOptions()
+	opts.Snapshots = slices.Clone(t.snapshots)
+	t.mu.Unlock()
+
+	var err error
+
+	opts.Replaces, err = replacedNames(getSegmentDirectory(t.settings.DataDirectory), inputs)
+	if err != nil {
+		return fmt.Errorf("Could not name compaction inputs: %w", err)
+	}
+
+	path, err := t.generateNewSegmentPath(c.OutputLevel)
+	if err != nil {
+		return fmt.Errorf("Error getting level %d segment path: %w", c.OutputLevel, err)
+	}
+
+	merged, err := sstable.MergeAll(inputs, *path, last, opts)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	for level, r := range inputRanges {
+		if r == nil {
+			continue
+		}
+		remaining := make([]*sstable.Table, 0, len(t.segments[level])-(r.End-r.Start)+1)
+		remaining = append(remaining, t.segments[level][:r.Start]...)
+		if level == c.OutputLevel {
+			remaining = append(remaining, merged)
+		}
+		remaining = append(remaining, t.segments[level][r.End:]...)
+		t.segments[level] = remaining
+	}
+	t.mu.Unlock()
+
+	// Readers may still be searching the inputs, so their files are only
+	// removed once released.
+	t.obsoleteMu.Lock()
+	for i := len(inputs) - 1; i >= 0; i-- {
+		t.obsolete = append(t.obsolete, inputs[i])
+	}
+	t.obsoleteMu.Unlock()
+	return t.removeObsolete()
+}
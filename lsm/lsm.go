@@ -1,45 +1,233 @@
 package lsm
 
 import (
+	"bigsby/bloom"
 	"bigsby/redblack"
 	"bigsby/sstable"
 	"bigsby/storage"
+	"bigsby/wal"
+	"cmp"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type KeyType = string
 type ValueType = string
-type Memtable = redblack.Tree[KeyType, ValueType]
-type Node = redblack.Node[KeyType, ValueType]
+
+// Memtable holds the versions of each key, newest first. Older versions are
+// only kept while a snapshot can see them.
+type Memtable = redblack.Tree[KeyType, []storage.EntryData]
+type Node = redblack.Node[KeyType, []storage.EntryData]
 
 type LSMTree struct {
-	memtable     Memtable
+	memtable *Memtable
+	// rangeDels holds the range deletes written to the memtable.
+	rangeDels    []storage.EntryData
 	levels       [][]sstable.Table
 	memtableSize int
 	settings     *Settings
-	segments     [][]sstable.Table
+	segments     [][]*sstable.Table
+	log          *wal.Log
+	// seq is the sequence number of the last write, and snapshots holds
+	// the sequence numbers of live snapshots in ascending order. Both are
+	// guarded by mu.
+	seq       uint64
+	snapshots []uint64
+
+	// Full memtables waiting to be written to level 0, oldest first. They
+	// are still searched until their segment is installed.
+	immutable []*immutableMemtable
+
+	// mu guards the memtables and segments. Readers only hold it to look
+	// through the memtables and take references to the current segments.
+	// flushMu and compactMu serialize flushes and compactions, which do
+	// their disk work without holding mu.
+	mu        sync.RWMutex
+	flushMu   sync.Mutex
+	compactMu sync.Mutex
+
+	// Compacted segments waiting for readers to release them before their
+	// files are removed, oldest first.
+	obsolete   []*sstable.Table
+	obsoleteMu sync.Mutex
+
+	// Signalled when an immutable memtable is installed as a segment.
+	flushed *sync.Cond
+	// The last background flush or compaction error, cleared on success.
+	backgroundErr error
+
+	flushRequests   chan struct{}
+	compactRequests chan struct{}
+	closing         chan struct{}
+	workers         sync.WaitGroup
+}
+
+type immutableMemtable struct {
+	memtable  *Memtable
+	rangeDels []storage.EntryData
+	size      int
+	// The log generation holding this memtable's writes.
+	logGen uint64
 }
 
+// Writers wait for the background flush once this many memtables are
+// queued, so memory use stays bounded when writes outpace the disk.
+const maxImmutableMemtables = 4
+
 type Settings struct {
 	CompactionLimit      int
 	DataDirectory        string
 	LevelZeroMaxSegments int
+	// LevelOneMaxSize is the size in bytes level 1 may reach before it is
+	// compacted into level 2. Each deeper level may be LevelSizeRatio times
+	// larger than the one above.
+	LevelOneMaxSize int
+	LevelSizeRatio  int
+	// CompactionStrategy picks segments to merge. It defaults to
+	// LeveledCompaction using the level settings above.
+	CompactionStrategy CompactionStrategy
+	// SyncMode controls when writes are fsynced to the log. SyncInterval
+	// is the period used by wal.SyncInterval.
+	SyncMode     wal.SyncMode
+	SyncInterval time.Duration
+	// Compression is used for the data blocks of new segments.
+	Compression sstable.Compression
+	// BloomFalsePositiveRate is the false positive rate segment filters are
+	// sized for. It defaults to bloom.DefaultFalsePositiveRate.
+	BloomFalsePositiveRate float64
+	// BloomHash is the hash segment filters use. It defaults to
+	// bloom.DefaultHash.
+	BloomHash bloom.Hash
+	// BlockedBloomFilter makes segments use cache-line blocked filters,
+	// which are faster to probe.
+	BlockedBloomFilter bool
+	// PrefixExtractor, if set, adds key prefixes to segment filters so
+	// segments without a prefix can be skipped.
+	PrefixExtractor sstable.PrefixExtractor
+	// Clock gives the time entries written with a TTL expire against. It
+	// defaults to time.Now.
+	Clock func() time.Time
+	// MergeOperator folds the operands written by Merge into values. It is
+	// needed to read keys with operands, so it must not change once any
+	// are written.
+	MergeOperator sstable.MergeOperator
 }
 
 const segmentNameLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const segmentSuffix = ".segment"
 
+// withDefaults returns a copy of the settings with unset fields filled in.
+func (s Settings) withDefaults() *Settings {
+	if s.LevelZeroMaxSegments <= 0 {
+		s.LevelZeroMaxSegments = defaultLevelZeroMaxSegments
+	}
+	if s.LevelSizeRatio <= 1 {
+		s.LevelSizeRatio = defaultLevelSizeRatio
+	}
+	if s.LevelOneMaxSize <= 0 {
+		s.LevelOneMaxSize = max(s.CompactionLimit*s.LevelSizeRatio, minLevelOneMaxSize)
+	}
+	if s.Clock == nil {
+		s.Clock = time.Now
+	}
+	if s.CompactionStrategy == nil {
+		s.CompactionStrategy = &LeveledCompaction{
+			LevelZeroMaxSegments: s.LevelZeroMaxSegments,
+			LevelOneMaxSize:      s.LevelOneMaxSize,
+			LevelSizeRatio:       s.LevelSizeRatio,
+		}
+	}
+	return &s
+}
+
+func (s *Settings) segmentOptions() *sstable.Options {
+	return &sstable.Options{
+		Compression:             s.Compression,
+		FilterFalsePositiveRate: s.BloomFalsePositiveRate,
+		FilterHash:              s.BloomHash,
+		BlockedFilter:           s.BlockedBloomFilter,
+		PrefixExtractor:         s.PrefixExtractor,
+		Clock:                   s.Clock,
+		MergeOperator:           s.MergeOperator,
+	}
+}
+
 func getSegmentDirectory(dataDirectory string) string {
 	return filepath.Join(dataDirectory, "segments")
 }
 
+func getLogDirectory(dataDirectory string) string {
+	return filepath.Join(dataDirectory, "wal")
+}
+
+// Log records are prefixed with a type byte so new record layouts can be
+// added without breaking replay of existing logs.
+const (
+	// logRecordEntry records were written before sequence numbers, which
+	// are assigned in log order on replay.
+	logRecordEntry byte = iota + 1
+	// logRecordSeqEntry and logRecordSeqBatch records were written before
+	// entries had a kind.
+	logRecordSeqEntry
+	logRecordSeqBatch
+	logRecordKindEntry
+	logRecordBatch
+)
+
+func encodeLogRecord(entry storage.EntryData) []byte {
+	return append([]byte{logRecordKindEntry}, storage.EncodeEntry(entry)...)
+}
+
+func (t *LSMTree) applyLogRecord(record []byte) error {
+	if len(record) == 0 {
+		return fmt.Errorf("Empty log record")
+	}
+
+	switch record[0] {
+	case logRecordEntry:
+		entry, _, err := storage.DecodeLogEntry(record[1:])
+		if err != nil {
+			return fmt.Errorf("Could not decode log record: %w", err)
+		}
+		entry.Seq = t.seq + 1
+		t.insertMemtable(*entry)
+	case logRecordSeqEntry, logRecordKindEntry:
+		decode := storage.DecodeEntry
+		if record[0] == logRecordSeqEntry {
+			decode = storage.DecodeSeqEntry
+		}
+		entry, _, err := decode(record[1:])
+		if err != nil {
+			return fmt.Errorf("Could not decode log record: %w", err)
+		}
+		t.insertMemtable(*entry)
+	case logRecordSeqBatch, logRecordBatch:
+		decode := storage.DecodeEntry
+		if record[0] == logRecordSeqBatch {
+			decode = storage.DecodeSeqEntry
+		}
+		entries, err := decodeBatchRecord(record[1:], decode)
+		if err != nil {
+			return fmt.Errorf("Could not decode log record: %w", err)
+		}
+		for _, entry := range entries {
+			t.insertMemtable(entry)
+		}
+	default:
+		return fmt.Errorf("Unknown log record type %d", record[0])
+	}
+	return nil
+}
+
 func (t *LSMTree) generateNewSegmentPath(level int) (*string, error) {
 	levelDir := filepath.Join(getSegmentDirectory(t.settings.DataDirectory), strconv.Itoa(level))
 	err := os.MkdirAll(levelDir, os.ModePerm)
@@ -60,48 +248,159 @@ func (t *LSMTree) generateNewSegmentPath(level int) (*string, error) {
 	}
 }
 
-func (t *LSMTree) Flush() error {
+// rotateMemtable queues the current memtable to be flushed, and starts a
+// new memtable and log file for incoming writes. Must be called with mu
+// held, which is released while a log file is created if none was
+// prepared.
+func (t *LSMTree) rotateMemtable() error {
+	if t.memtable.Height() == 0 && len(t.rangeDels) == 0 {
+		return nil
+	}
 
-	// segmentData, err := t.segment.Read()
-	// if err != nil {
-	// 	return err
-	// }
-
-	entries := make([]storage.EntryData, 0)
-	for k, v := range t.memtable.InOrder() {
-		// While we still have segment values, we need to compare.
-		entries = append(entries, storage.EntryData{
-			Key:   k,
-			Value: v,
-		})
+	// Writes from here on go to a new log file, so the current one
+	// can be dropped once the segment is on disk. Creating that file
+	// means syncing it, which readers should not wait on.
+	memtable := t.memtable
+	logGen, ok := t.log.RotatePrepared()
+	for !ok {
+		t.mu.Unlock()
+		err := t.log.Prepare()
+		t.mu.Lock()
+		if err != nil {
+			return fmt.Errorf("Error preparing log: %w", err)
+		}
+		if t.memtable != memtable {
+			// Another writer rotated it in the meantime.
+			return nil
+		}
+		logGen, ok = t.log.RotatePrepared()
 	}
 
-	path, err := t.generateNewSegmentPath(0)
-	if err != nil {
-		return fmt.Errorf("Error getting level 0 segment path: %w", err)
+	t.immutable = append(t.immutable, &immutableMemtable{
+		memtable:  t.memtable,
+		rangeDels: t.rangeDels,
+		size:      t.memtableSize,
+		logGen:    logGen,
+	})
+	t.memtable = &Memtable{}
+	t.rangeDels = nil
+	t.memtableSize = 0
+	return nil
+}
+
+// flushImmutable writes queued memtables to level 0, oldest first.
+func (t *LSMTree) flushImmutable() error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+
+	for {
+		// Have a log file ready for the next rotation, so it does not
+		// need to create one under mu.
+		err := t.log.Prepare()
+		if err != nil {
+			return fmt.Errorf("Error preparing log: %w", err)
+		}
+
+		t.mu.Lock()
+		if len(t.immutable) == 0 {
+			t.mu.Unlock()
+			break
+		}
+		imm := t.immutable[0]
+		t.mu.Unlock()
+
+		entries := make([]storage.EntryData, 0)
+		for _, versions := range imm.memtable.InOrder() {
+			entries = append(entries, versions...)
+		}
+		entries = append(entries, imm.rangeDels...)
+
+		path, err := t.generateNewSegmentPath(0)
+		if err != nil {
+			return fmt.Errorf("Error getting level 0 segment path: %w", err)
+		}
+
+		segment, err := sstable.Create(*path, entries, t.settings.segmentOptions())
+		if err != nil {
+			return err
+		}
+
+		t.mu.Lock()
+		if len(t.segments) == 0 {
+			t.segments = append(t.segments, make([]*sstable.Table, 0))
+		}
+		t.segments[0] = append(t.segments[0], segment)
+		t.immutable = t.immutable[1:]
+		t.flushed.Broadcast()
+		t.mu.Unlock()
+
+		err = t.log.RemoveThrough(imm.logGen)
+		if err != nil {
+			return fmt.Errorf("Error truncating log: %w", err)
+		}
 	}
 
-	segment, err := sstable.Create(*path, entries)
+	// Level 0 may now be over its limit.
+	select {
+	case t.compactRequests <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush writes the memtable, and any memtables already queued for the
+// background flush, to level 0 segments.
+func (t *LSMTree) Flush() error {
+	t.mu.Lock()
+	err := t.rotateMemtable()
+	t.mu.Unlock()
 	if err != nil {
 		return err
 	}
+	return t.flushImmutable()
+}
 
-	if len(t.segments) == 0 {
-		t.segments = append(t.segments, make([]sstable.Table, 0))
-	}
-	t.segments[0] = append(t.segments[0], *segment)
+// Compact runs compactions until the compaction strategy has nothing left
+// to merge.
+func (t *LSMTree) Compact() error {
+	t.compactMu.Lock()
+	defer t.compactMu.Unlock()
+	return t.compact()
+}
 
-	// TODO: Merge/Compact
+func (t *LSMTree) setBackgroundErr(err error) {
+	t.mu.Lock()
+	t.backgroundErr = err
+	t.flushed.Broadcast()
+	t.mu.Unlock()
+}
 
-	// Reset memtable.
-	// TODO: Make memtable immutable while writing segment
-	// and make a new one for incoming writes.
-	t.memtable = Memtable{}
-	t.memtableSize = 0
-	return nil
+func (t *LSMTree) flushWorker() {
+	defer t.workers.Done()
+	for {
+		select {
+		case <-t.closing:
+			return
+		case <-t.flushRequests:
+			t.setBackgroundErr(t.flushImmutable())
+		}
+	}
+}
+
+func (t *LSMTree) compactWorker() {
+	defer t.workers.Done()
+	for {
+		select {
+		case <-t.closing:
+			return
+		case <-t.compactRequests:
+			t.setBackgroundErr(t.Compact())
+		}
+	}
 }
 
 func New(settings *Settings) (*LSMTree, error) {
+	settings = settings.withDefaults()
 	segmentDirectory := getSegmentDirectory(settings.DataDirectory)
 
 	err := os.MkdirAll(segmentDirectory, os.ModePerm)
@@ -109,7 +408,7 @@ func New(settings *Settings) (*LSMTree, error) {
 		return nil, fmt.Errorf("Failed to make segment dir: %w", err)
 	}
 
-	segments := make([][]sstable.Table, 0)
+	segments := make([][]*sstable.Table, 0)
 	level := 0
 	for {
 		levelDir := filepath.Join(segmentDirectory, strconv.Itoa(level))
@@ -120,104 +419,512 @@ func New(settings *Settings) (*LSMTree, error) {
 			}
 		}
 
-		sort.Slice(files, func(i, j int) bool {
-			iInfo, err := files[i].Info()
-			if err != nil {
-				return true
-			}
-
-			jInfo, err := files[j].Info()
-			if err != nil {
-				return false
-			}
-
-			return iInfo.ModTime().Before(jInfo.ModTime())
-		})
-
-		segments = append(segments, make([]sstable.Table, 0))
+		segments = append(segments, make([]*sstable.Table, 0))
+		modTimes := make(map[*sstable.Table]time.Time)
 		for _, f := range files {
 			if f.IsDir() {
 				continue
 			}
+			// A segment still being written when the tree last stopped.
+			if strings.HasSuffix(f.Name(), segmentSuffix+sstable.TempSuffix) {
+				err = os.Remove(filepath.Join(levelDir, f.Name()))
+				if err != nil {
+					return nil, fmt.Errorf("Failed to remove partial segment: %w", err)
+				}
+				continue
+			}
 			if !strings.HasSuffix(f.Name(), segmentSuffix) {
 				continue
 			}
 
-			segment, err := sstable.Load(filepath.Join(levelDir, f.Name()))
+			segment, err := sstable.Load(filepath.Join(levelDir, f.Name()), settings.segmentOptions())
 			if err != nil {
 				return nil, fmt.Errorf("Failed to read segment: %w", err)
 			}
-			segments[level] = append(segments[level], *segment)
+			info, err := f.Info()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to stat segment: %w", err)
+			}
+			modTimes[segment] = info.ModTime()
+			segments[level] = append(segments[level], segment)
 		}
+
+		// Newer segments hold newer sequence numbers. Segments written
+		// before there were sequence numbers fall back on file times.
+		slices.SortFunc(segments[level], func(a, b *sstable.Table) int {
+			if c := cmp.Compare(a.MaxSeq(), b.MaxSeq()); c != 0 {
+				return c
+			}
+			if c := modTimes[a].Compare(modTimes[b]); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.FilePath, b.FilePath)
+		})
 		level++
 	}
+	segments, err = discardReplaced(segmentDirectory, segments)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &LSMTree{
+		memtable:        &Memtable{},
+		settings:        settings,
+		segments:        segments,
+		flushRequests:   make(chan struct{}, 1),
+		compactRequests: make(chan struct{}, 1),
+		closing:         make(chan struct{}),
+	}
+	tree.flushed = sync.NewCond(&tree.mu)
+	for _, level := range segments {
+		for _, segment := range level {
+			tree.seq = max(tree.seq, segment.MaxSeq())
+		}
+	}
+
+	// Recover anything that was written but not yet flushed to a segment.
+	logDirectory := getLogDirectory(settings.DataDirectory)
+	err = wal.Replay(logDirectory, tree.applyLogRecord)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to replay log: %w", err)
+	}
+
+	tree.log, err = wal.Open(logDirectory, settings.SyncMode, settings.SyncInterval)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open log: %w", err)
+	}
 
-	return &LSMTree{
-		settings: settings,
-		segments: segments,
-	}, nil
+	tree.workers.Add(2)
+	go tree.flushWorker()
+	go tree.compactWorker()
+	return tree, nil
 }
 
+// insertMemtable adds a new version of a key, dropping the versions it
+// hides from every snapshot, or a range delete. Must be called with mu held.
+func (t *LSMTree) insertMemtable(entry storage.EntryData) {
+	t.memtableSize += len(entry.Key) + len(entry.Value)
+	t.seq = max(t.seq, entry.Seq)
+	if entry.Kind == storage.KindRangeDelete {
+		t.rangeDels = append(t.rangeDels, entry)
+		return
+	}
+
+	versions := []storage.EntryData{entry}
+	if older := t.memtable.Search(entry.Key); older != nil {
+		// Versions beneath merge operands are kept for them to apply to.
+		newer := uint64(math.MaxUint64)
+		if entry.Kind != storage.KindMerge {
+			newer = entry.Seq
+		}
+		for _, version := range *older {
+			if newer == math.MaxUint64 || storage.SnapshotSees(t.snapshots, version.Seq, newer) {
+				versions = append(versions, version)
+			}
+			if version.Kind != storage.KindMerge {
+				newer = version.Seq
+			}
+		}
+	}
+	t.memtable.Insert(entry.Key, versions)
+}
+
+// Insert is safe to call concurrently. The log is synced after the write is
+// applied, so a write may be visible to readers shortly before Insert
+// returns. With wal.SyncGroupCommit, concurrent writers share log syncs.
 func (t *LSMTree) Insert(key KeyType, value ValueType) error {
-	// TODO: WAL before inserting to memtable.
-	t.memtable.Insert(key, value)
-	t.memtableSize += len(key) + len(value)
+	batch := &WriteBatch{}
+	batch.Put(key, value)
+	return t.Write(batch)
+}
+
+// writeLocked logs and applies entries under mu, giving them consecutive
+// sequence numbers, and returns the log position to wait for. If validate
+// is set, it is called under mu first, and nothing is written if it fails.
+func (t *LSMTree) writeLocked(batch []storage.EntryData, validate func() error) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.immutable) >= maxImmutableMemtables {
+		if t.backgroundErr != nil {
+			return 0, fmt.Errorf("Error flushing memtable: %w", t.backgroundErr)
+		}
+		t.flushed.Wait()
+	}
+	if validate != nil {
+		err := validate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The log write and memtable insert happen under the same lock, so
+	// the log replays writes in the order the memtable saw them.
+	entries := make([]storage.EntryData, len(batch))
+	for i, entry := range batch {
+		entry.Seq = t.seq + uint64(i) + 1
+		entries[i] = entry
+	}
+	record := encodeBatchRecord(entries)
+	if len(entries) == 1 {
+		record = encodeLogRecord(entries[0])
+	}
+	logPos, err := t.log.Write(record)
+	if err != nil {
+		return 0, fmt.Errorf("Error writing to log: %w", err)
+	}
+	for _, entry := range entries {
+		t.insertMemtable(entry)
+	}
 
 	if t.memtableSize > t.settings.CompactionLimit {
-		err := t.Flush()
+		err := t.rotateMemtable()
+		if err != nil {
+			return 0, fmt.Errorf("Error flushing memtable: %w", err)
+		}
+		select {
+		case t.flushRequests <- struct{}{}:
+		default:
+		}
+	}
+	return logPos, nil
+}
+
+// refSegments returns the current segments, referenced so that they stay on
+// disk until the caller passes them to unrefSegments. Must be called with mu
+// held.
+func (t *LSMTree) refSegments() [][]*sstable.Table {
+	segments := slices.Clone(t.segments)
+	for _, level := range segments {
+		for _, segment := range level {
+			segment.Ref()
+		}
+	}
+	return segments
+}
+
+func (t *LSMTree) unrefSegments(segments [][]*sstable.Table) {
+	for _, level := range segments {
+		for _, segment := range level {
+			segment.Unref()
+		}
+	}
+	// A failed removal is retried on the next release.
+	t.removeObsolete()
+}
+
+// discardReplaced removes the compaction inputs that a crash left behind
+// after their merged segment was written, as any of them could shadow the
+// merged data.
+func discardReplaced(segmentDirectory string, segments [][]*sstable.Table) ([][]*sstable.Table, error) {
+	replaced := make(map[string]bool)
+	for _, level := range segments {
+		for _, segment := range level {
+			for _, name := range segment.Replaces() {
+				replaced[filepath.Join(segmentDirectory, name)] = true
+			}
+		}
+	}
+	if len(replaced) == 0 {
+		return segments, nil
+	}
+
+	for level := range segments {
+		var err error
+		segments[level] = slices.DeleteFunc(segments[level], func(segment *sstable.Table) bool {
+			if err != nil || !replaced[segment.FilePath] {
+				return false
+			}
+			err = segment.Remove()
+			return err == nil
+		})
 		if err != nil {
-			return fmt.Errorf("Error flushing memtable: %w", err)
+			return nil, fmt.Errorf("Failed to remove compacted segment: %w", err)
+		}
+	}
+	return segments, nil
+}
+
+// replacedNames returns the names, relative to the segment directory, that
+// a segment merged from inputs replaces. Names the inputs replaced are
+// carried over while their files remain, since they are only discarded
+// while a segment naming them is loaded.
+func replacedNames(segmentDirectory string, inputs []*sstable.Table) ([]string, error) {
+	names := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		name, err := filepath.Rel(segmentDirectory, input.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		for _, name := range input.Replaces() {
+			_, err = os.Stat(filepath.Join(segmentDirectory, name))
+			if err == nil {
+				names = append(names, name)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
 		}
 	}
+	return names, nil
+}
+
+// removeObsolete deletes compacted segment files once no reader holds them.
+// The merged segment records the inputs it replaces, so inputs left by a
+// crash part way through are discarded by New.
+func (t *LSMTree) removeObsolete() error {
+	t.obsoleteMu.Lock()
+	defer t.obsoleteMu.Unlock()
+
+	for len(t.obsolete) > 0 && !t.obsolete[0].InUse() {
+		err := t.obsolete[0].Remove()
+		if err != nil {
+			return fmt.Errorf("Failed to remove compacted segment: %w", err)
+		}
+		t.obsolete = t.obsolete[1:]
+	}
 	return nil
 }
 
-func (t *LSMTree) searchSegments(key KeyType) (*ValueType, error) {
-	for _, level := range t.segments {
+// searchSegments returns the newest entry for key at or below seq. Newer
+// segments only hold newer versions, so the first one found is it.
+func searchSegments(segments [][]*sstable.Table, key KeyType, seq uint64) (*storage.EntryData, error) {
+	for _, level := range segments {
 		for i := len(level) - 1; i >= 0; i-- {
-			valuePtr, err := level[i].Search(key)
+			entry, err := level[i].Get(key, seq)
 			if err != nil {
 				return nil, err
 			}
 
-			if valuePtr != nil {
-				return valuePtr, nil
+			if entry != nil {
+				return entry, nil
 			}
 		}
 	}
 	return nil, nil
 }
 
-func (t *LSMTree) Search(key KeyType) (*ValueType, error) {
-	var err error
-	value := t.memtable.Search(key)
-	if value == nil {
-		value, err = t.searchSegments(key)
+// searchMemtable returns the newest entry for key at or below seq among its
+// versions in a memtable and the memtable's range deletes, as
+// sstable.Table.Get does for a segment.
+func searchMemtable(versions *[]storage.EntryData, rangeDels []storage.EntryData, key KeyType, seq uint64) *storage.EntryData {
+	entry := searchVersions(versions, seq)
+	rangeSeq := storage.NewestRangeDelete(rangeDels, key, seq)
+	if rangeSeq > 0 && (entry == nil || rangeSeq > entry.Seq) {
+		return &storage.EntryData{Key: key, Seq: rangeSeq, Kind: storage.KindDelete}
+	}
+	return entry
+}
+
+func searchVersions(versions *[]storage.EntryData, seq uint64) *storage.EntryData {
+	if versions == nil {
+		return nil
+	}
+	for _, version := range *versions {
+		if version.Seq <= seq {
+			return &version
+		}
+	}
+	return nil
+}
+
+// searchMemtables returns a copy of the newest memtable entry for key at or
+// below seq, since the memtable node may be overwritten once mu is released.
+// Must be called with mu held.
+func (t *LSMTree) searchMemtables(key KeyType, seq uint64) *storage.EntryData {
+	entry := searchMemtable(t.memtable.Search(key), t.rangeDels, key, seq)
+	for i := len(t.immutable) - 1; entry == nil && i >= 0; i-- {
+		entry = searchMemtable(t.immutable[i].memtable.Search(key), t.immutable[i].rangeDels, key, seq)
+	}
+	return entry
+}
+
+// readView is a fixed set of memtables and segments to read from, so that a
+// read looking up several versions of a key sees them all as of the same
+// moment. Otherwise a compaction between lookups could fold the merge
+// operands still to be read into the one already read.
+type readView struct {
+	// active holds the versions of keys in the active memtable, which keeps
+	// changing once mu is released. The immutable memtables do not.
+	active          map[KeyType][]storage.EntryData
+	activeRangeDels []storage.EntryData
+	immutable       []*immutableMemtable
+	segments        [][]*sstable.Table
+}
+
+// newView returns a view of the tree holding the active memtable's versions
+// of keys. More keys can be added to active while mu is held. Must be called
+// with mu held, and the view passed to releaseView once done with.
+func (t *LSMTree) newView(keys ...KeyType) *readView {
+	view := &readView{
+		active:          make(map[KeyType][]storage.EntryData),
+		activeRangeDels: slices.Clone(t.rangeDels),
+		immutable:       slices.Clone(t.immutable),
+		segments:        t.refSegments(),
+	}
+	for _, key := range keys {
+		view.addActive(t.memtable, key)
+	}
+	return view
+}
+
+// addActive copies the versions of key in the active memtable into the view.
+// Must be called with mu held.
+func (v *readView) addActive(memtable *Memtable, key KeyType) {
+	if versions := memtable.Search(key); versions != nil {
+		v.active[key] = *versions
+	}
+}
+
+func (t *LSMTree) releaseView(v *readView) {
+	t.unrefSegments(v.segments)
+}
+
+// get returns the newest entry for key at or below seq in the view, which
+// may be a tombstone.
+func (v *readView) get(key KeyType, seq uint64) (*storage.EntryData, error) {
+	versions := v.active[key]
+	entry := searchMemtable(&versions, v.activeRangeDels, key, seq)
+	for i := len(v.immutable) - 1; entry == nil && i >= 0; i-- {
+		entry = searchMemtable(v.immutable[i].memtable.Search(key), v.immutable[i].rangeDels, key, seq)
+	}
+	if entry != nil {
+		return entry, nil
+	}
+	return searchSegments(v.segments, key, seq)
+}
+
+// search returns the value of key as of seq, applying any merge operands
+// to the value beneath them.
+func (t *LSMTree) search(key KeyType, seq uint64) (*ValueType, error) {
+	t.mu.RLock()
+	// Without operands only the newest entry is needed, which is often
+	// found in the memtables.
+	entry := t.searchMemtables(key, seq)
+	if entry != nil && entry.Kind != storage.KindMerge {
+		t.mu.RUnlock()
+		return t.resolve(key, entry, nil)
+	}
+	view := t.newView(key)
+	t.mu.RUnlock()
+	defer t.releaseView(view)
+
+	return t.searchView(view, key, seq)
+}
+
+// searchView returns the value of key as of seq in view, applying any merge
+// operands to the value beneath them.
+func (t *LSMTree) searchView(view *readView, key KeyType, seq uint64) (*ValueType, error) {
+	operands := make([]string, 0)
+	for {
+		entry, err := view.get(key, seq)
 		if err != nil {
 			return nil, err
 		}
+		if entry == nil || entry.Kind != storage.KindMerge {
+			return t.resolve(key, entry, operands)
+		}
+		operands = append(operands, entry.Value)
+		seq = entry.Seq - 1
 	}
+}
+
+// resolve applies operands, newest first, to the value of entry, the
+// newest version beneath them.
+func (t *LSMTree) resolve(key KeyType, entry *storage.EntryData, operands []string) (*ValueType, error) {
+	var existing *ValueType
+	if entry != nil && entry.Kind == storage.KindPut && !entry.Expired(t.settings.Clock()) {
+		existing = &entry.Value
+	}
+	slices.Reverse(operands)
+	return t.applyOperands(key, existing, operands)
+}
 
-	if value != nil && *value == storage.Tombstone {
-		return nil, nil
+// applyOperands merges operands, oldest first, into the existing value.
+func (t *LSMTree) applyOperands(key KeyType, existing *ValueType, operands []string) (*ValueType, error) {
+	if len(operands) == 0 {
+		return existing, nil
+	}
+	if t.settings.MergeOperator == nil {
+		return nil, fmt.Errorf("No merge operator to apply operands for key %s", key)
+	}
+	value, err := t.settings.MergeOperator.Merge(key, existing, operands)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to merge operands for key %s: %w", key, err)
 	}
-	return value, nil
+	return &value, nil
+}
+
+func (t *LSMTree) Search(key KeyType) (*ValueType, error) {
+	return t.search(key, math.MaxUint64)
+}
+
+// Merge records operand as an update to key, which Settings.MergeOperator
+// applies to the key's current value when it is read.
+func (t *LSMTree) Merge(key KeyType, operand string) error {
+	batch := &WriteBatch{}
+	batch.Merge(key, operand)
+	return t.Write(batch)
 }
 
 func (t *LSMTree) Remove(key KeyType) error {
-	return t.Insert(key, storage.Tombstone)
+	batch := &WriteBatch{}
+	batch.Delete(key)
+	return t.Write(batch)
+}
+
+// InsertWithTTL inserts a value that is treated as removed once ttl has
+// passed, by Settings.Clock.
+func (t *LSMTree) InsertWithTTL(key KeyType, value ValueType, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("Invalid TTL %v", ttl)
+	}
+	batch := &WriteBatch{}
+	batch.entries = append(batch.entries, storage.EntryData{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: t.settings.Clock().Add(ttl).UnixNano(),
+	})
+	return t.Write(batch)
+}
+
+// DeleteRange removes every key in [start, end) with a single range delete,
+// which compaction applies to the keys it covers. An empty end means there
+// is no upper bound.
+func (t *LSMTree) DeleteRange(start KeyType, end KeyType) error {
+	batch := &WriteBatch{}
+	batch.DeleteRange(start, end)
+	return t.Write(batch)
+}
+
+// Close stops background work and releases the log. Unflushed writes are
+// recovered from it by the next call to New.
+func (t *LSMTree) Close() error {
+	close(t.closing)
+	t.workers.Wait()
+	return t.log.Close()
 }
 
 func (t *LSMTree) PrintMemtable(out io.Writer) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	io.WriteString(out, fmt.Sprintf("Immutable: %d\n", len(t.immutable)))
 	io.WriteString(out, fmt.Sprintf("Size: %d\n", t.memtableSize))
 	io.WriteString(out, fmt.Sprintf("Height: %d\n", t.memtable.Height()))
+	io.WriteString(out, fmt.Sprintf("Range deletes: %v\n", t.rangeDels))
 	io.WriteString(out, "Tree:\n\n")
 	t.memtable.Print(out)
 	io.WriteString(out, "\n")
 }
 
 func (t *LSMTree) PrintSegments(out io.Writer) {
-	for level, segments := range t.segments {
+	t.mu.RLock()
+	levels := t.refSegments()
+	t.mu.RUnlock()
+	defer t.unrefSegments(levels)
+
+	for level, segments := range levels {
 		io.WriteString(out, fmt.Sprintf("Level %d:\n", level))
 		for _, segment := range segments {
 			data, err := segment.Read()
@@ -2,7 +2,11 @@ package lsm
 
 import (
 	"bigsby/storage"
+	"fmt"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestWriteSegment(t *testing.T) {
@@ -311,3 +315,453 @@ func TestRemoveFromSegment(t *testing.T) {
 		t.Error("Found value for hello in memtable after delete/compaction")
 	}
 }
+
+func TestRecoverFromLog(t *testing.T) {
+	segmentDirectory := t.TempDir()
+	settings := &Settings{
+		CompactionLimit: 1000,
+		DataDirectory:   segmentDirectory,
+	}
+
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Insert("hello", "world")
+	tree.Insert("good", "bye")
+	tree.Remove("good")
+	// Simulate a crash: nothing has been flushed to a segment.
+	tree.Close()
+
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	valPtr, err := tree.Search("hello")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr == nil || *valPtr != "world" {
+		t.Error("Could not find key after recovering from log")
+	}
+
+	valPtr, err = tree.Search("good")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr != nil {
+		t.Errorf("Expected nil value for removed key after recovery, got %s", *valPtr)
+	}
+}
+
+func TestFlushTruncatesLog(t *testing.T) {
+	segmentDirectory := t.TempDir()
+	settings := &Settings{
+		CompactionLimit: 1000,
+		DataDirectory:   segmentDirectory,
+	}
+
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Insert("hello", "world")
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Close()
+
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// The key lives in the segment, and must not be replayed into the memtable.
+	if tree.memtable.Search("hello") != nil {
+		t.Error("Found flushed key in memtable after recovery")
+	}
+
+	valPtr, err := tree.Search("hello")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr == nil || *valPtr != "world" {
+		t.Error("Could not find flushed key after reopening")
+	}
+}
+
+func TestLevelZeroCompaction(t *testing.T) {
+	segmentDirectory := t.TempDir()
+
+	tree, err := New(
+		&Settings{
+			CompactionLimit:      1000,
+			DataDirectory:        segmentDirectory,
+			LevelZeroMaxSegments: 2,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	tree.Insert("hello", "world")
+	tree.Insert("good", "bye")
+	tree.Flush()
+	tree.Insert("hello", "there")
+	tree.Flush()
+	tree.Remove("good")
+	tree.Insert("new", "entry")
+	tree.Flush()
+	err = tree.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.segments[0]) != 0 {
+		t.Errorf("Expected empty level 0 after compaction, got %d segments", len(tree.segments[0]))
+	}
+	if len(tree.segments) < 2 || len(tree.segments[1]) != 1 {
+		t.Fatal("Expected a single level 1 segment after compaction")
+	}
+
+	// Level 1 is the bottom level, so the tombstone should be dropped.
+	expectedEntries := []storage.EntryData{
+		{Key: "hello", Value: "there", Seq: 3},
+		{Key: "new", Value: "entry", Seq: 5},
+	}
+	entries, err := tree.segments[1][0].Read()
+	if err != nil {
+		t.Fatalf("Failed to read segment file: %v", err)
+	}
+	if len(*entries) != len(expectedEntries) {
+		t.Fatalf("Got %d entries after compaction (expected %d)", len(*entries), len(expectedEntries))
+	}
+	for i, entry := range *entries {
+		if entry != expectedEntries[i] {
+			t.Errorf("Got unexpected segment entry: %v (expected %v)", entry, expectedEntries[i])
+		}
+	}
+
+	valPtr, err := tree.Search("good")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr != nil {
+		t.Errorf("Expected nil value for removed key after compaction, got %s", *valPtr)
+	}
+}
+
+func TestLevelSizeCompaction(t *testing.T) {
+	segmentDirectory := t.TempDir()
+	settings := &Settings{
+		CompactionLimit:      1000,
+		DataDirectory:        segmentDirectory,
+		LevelZeroMaxSegments: 1,
+		LevelOneMaxSize:      1,
+		LevelSizeRatio:       1000000,
+	}
+
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Insert("hello", "world")
+	tree.Flush()
+	tree.Remove("hello")
+	tree.Insert("good", "bye")
+	tree.Flush()
+	err = tree.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any data at all overflows level 1, but level 2 has plenty of room.
+	if len(tree.segments) != 3 || len(tree.segments[1]) != 0 || len(tree.segments[2]) != 1 {
+		t.Fatalf("Expected all data in level 2, got %v", tree.segments)
+	}
+	tree.Close()
+
+	// Reopen to check the levels are picked up from disk.
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	valPtr, err := tree.Search("good")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr == nil || *valPtr != "bye" {
+		t.Error("Could not find key after compaction")
+	}
+
+	valPtr, err = tree.Search("hello")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr != nil {
+		t.Errorf("Expected nil value for removed key after compaction, got %s", *valPtr)
+	}
+}
+
+func TestBottomLevelCompaction(t *testing.T) {
+	// With no compaction limit every write fills the memtable, and no level
+	// below level 1 has room for the data.
+	tree, err := New(&Settings{
+		DataDirectory:        t.TempDir(),
+		LevelZeroMaxSegments: 1,
+		LevelOneMaxSize:      1,
+		LevelSizeRatio:       2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := range 10 {
+		tree.Insert(fmt.Sprintf("key%d", i), "value")
+	}
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.segments) != 2 || len(tree.segments[1]) != 1 {
+		t.Fatalf("Expected all data to stay in level 1, got %v", tree.segments)
+	}
+	if (Settings{}).withDefaults().LevelOneMaxSize <= 0 {
+		t.Error("Expected a positive default level 1 size")
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	segmentDirectory := t.TempDir()
+	strategy := NewSizeTieredCompaction()
+	strategy.MinThreshold = 3
+	settings := &Settings{
+		CompactionLimit:    100000,
+		DataDirectory:      segmentDirectory,
+		CompactionStrategy: strategy,
+	}
+
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One large segment, followed by three small ones of similar size.
+	for i := range 200 {
+		tree.Insert(fmt.Sprintf("key%03d", i), "some longer value to pad out the segment")
+	}
+	tree.Insert("hello", "old")
+	tree.Flush()
+
+	tree.Insert("hello", "new")
+	tree.Flush()
+	tree.Remove("key000")
+	tree.Flush()
+	tree.Insert("good", "bye")
+	tree.Flush()
+	err = tree.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.segments) != 1 || len(tree.segments[0]) != 2 {
+		t.Fatalf("Expected the small segments to be merged, got %v", tree.segments)
+	}
+	large, merged := tree.segments[0][0].FilePath, tree.segments[0][1].FilePath
+	tree.Close()
+
+	// Reopen to check the merged segment still shadows the large one, even
+	// once copying the files has reversed their times.
+	now := time.Now()
+	err = os.Chtimes(large, now, now)
+	if err == nil {
+		err = os.Chtimes(merged, now.Add(-time.Hour), now.Add(-time.Hour))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	valPtr, err := tree.Search("hello")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr == nil || *valPtr != "new" {
+		t.Error("Expected newest value for key after size-tiered compaction")
+	}
+
+	// The tombstone must survive, since the large segment is older.
+	valPtr, err = tree.Search("key000")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr != nil {
+		t.Errorf("Expected nil value for removed key after compaction, got %s", *valPtr)
+	}
+
+	valPtr, err = tree.Search("key001")
+	if err != nil {
+		t.Error(err)
+	}
+	if valPtr == nil {
+		t.Error("Could not find key from large segment after compaction")
+	}
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	segmentDirectory := t.TempDir()
+
+	tree, err := New(
+		&Settings{
+			CompactionLimit: 20,
+			DataDirectory:   segmentDirectory,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// Each insert overflows the memtable, so every write after the first
+	// goes to a fresh memtable while the old one is flushed.
+	for i := range 20 {
+		err = tree.Insert(fmt.Sprintf("key%02d", i), "a value that fills the memtable")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Should be readable whether or not it has reached a segment yet.
+		valPtr, err := tree.Search(fmt.Sprintf("key%02d", i))
+		if err != nil {
+			t.Error(err)
+		}
+		if valPtr == nil {
+			t.Errorf("Could not find key%02d right after insert", i)
+		}
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.mu.Lock()
+	if len(tree.immutable) != 0 || tree.memtableSize != 0 {
+		t.Error("Expected no memtable data after flush")
+	}
+	tree.mu.Unlock()
+
+	for i := range 20 {
+		valPtr, err := tree.Search(fmt.Sprintf("key%02d", i))
+		if err != nil {
+			t.Error(err)
+		}
+		if valPtr == nil {
+			t.Errorf("Could not find key%02d after flush", i)
+		}
+	}
+}
+
+func TestSearchSegmentIndex(t *testing.T) {
+	segmentDirectory := t.TempDir()
+	settings := &Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   segmentDirectory,
+	}
+
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough data to span several blocks.
+	for i := 0; i < 200; i += 2 {
+		tree.Insert(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d %s", i, strings.Repeat("x", 100)))
+	}
+	tree.Flush()
+	tree.Close()
+
+	// Reopen so the index is read back from disk.
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := range 200 {
+		valPtr, err := tree.Search(fmt.Sprintf("key%03d", i))
+		if err != nil {
+			t.Error(err)
+		}
+		if i%2 == 0 && (valPtr == nil || !strings.HasPrefix(*valPtr, fmt.Sprintf("value%d ", i))) {
+			t.Errorf("Could not find key%03d in segment", i)
+		}
+		if i%2 == 1 && valPtr != nil {
+			t.Errorf("Found unexpected value for key%03d: %s", i, *valPtr)
+		}
+	}
+}
+
+func TestInsertTombstoneValue(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := New(&Settings{
+		CompactionLimit: 1000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deletes no longer use a special value, so storing it must work like
+	// any other.
+	check := func(stage string) {
+		t.Helper()
+		valPtr, err := tree.Search("magic")
+		if err != nil || valPtr == nil || *valPtr != storage.Tombstone {
+			t.Errorf("Got %v, %v for the old tombstone value %s", valPtr, err, stage)
+		}
+	}
+	tree.Insert("magic", storage.Tombstone)
+	check("in the memtable")
+	tree.Close()
+
+	tree, err = New(&Settings{
+		CompactionLimit: 1000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check("after replay")
+	tree.Flush()
+	check("after flush")
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}, {Level: 1}},
+		OutputLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+}
@@ -0,0 +1,287 @@
+package lsm
+
+import (
+	"bigsby/storage"
+	"math"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type counterOperator struct{}
+
+func (counterOperator) Merge(key string, existing *string, operands []string) (string, error) {
+	total := 0
+	if existing != nil {
+		n, err := strconv.Atoi(*existing)
+		if err != nil {
+			return "", err
+		}
+		total = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.Atoi(operand)
+		if err != nil {
+			return "", err
+		}
+		total += n
+	}
+	return strconv.Itoa(total), nil
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	noOperator, err := New(&Settings{CompactionLimit: 100000, DataDirectory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noOperator.Merge("counter", "1") == nil {
+		t.Error("Merged without a merge operator")
+	}
+	noOperator.Close()
+
+	settings := &Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+		MergeOperator:   counterOperator{},
+	}
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Merge("counter", "1")
+	tree.Merge("counter", "2")
+	tree.Insert("base", "10")
+	tree.Flush()
+	tree.Merge("base", "5")
+	before := tree.Snapshot()
+	tree.Merge("base", "-3")
+	tree.Merge("counter", "3")
+	tree.Insert("reset", "100")
+	tree.Merge("reset", "1")
+	tree.Remove("reset")
+	tree.Merge("reset", "7")
+
+	check := func(stage string) {
+		t.Helper()
+		expected := map[string]string{"base": "12", "counter": "6", "reset": "7"}
+		for key, value := range expected {
+			valPtr, err := tree.Search(key)
+			if err != nil || valPtr == nil || *valPtr != value {
+				t.Errorf("Got %v, %v for %s %s (expected %s)", valPtr, err, key, stage, value)
+			}
+		}
+		scan, scanErr := tree.Scan("", "")
+		found := 0
+		for key, value := range scan {
+			if value != expected[key] {
+				t.Errorf("Scanned %s=%s %s (expected %s)", key, value, stage, expected[key])
+			}
+			found++
+		}
+		if scanErr() != nil {
+			t.Fatal(scanErr())
+		}
+		if found != len(expected) {
+			t.Errorf("Scanned %d keys %s (expected %d)", found, stage, len(expected))
+		}
+	}
+	check("in the memtable")
+
+	// Snapshots see the operands written before them.
+	valPtr, err := before.Search("base")
+	if err != nil || valPtr == nil || *valPtr != "15" {
+		t.Errorf("Got %v, %v for base in snapshot", valPtr, err)
+	}
+	before.Release()
+
+	tree.Close()
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check("after replay")
+	tree.Flush()
+	check("after flush")
+
+	// Compaction folds the operands into plain values.
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}, {Level: 1}},
+		OutputLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+	entries, err := tree.segments[1][0].Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range *entries {
+		if entry.Kind != storage.KindPut {
+			t.Errorf("Got %v after compaction (expected only puts)", entry)
+		}
+	}
+	if len(*entries) != 3 {
+		t.Errorf("Got %d entries after compaction (expected 3)", len(*entries))
+	}
+}
+
+func TestMergeWithTTL(t *testing.T) {
+	var now atomic.Int64
+	now.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   t.TempDir(),
+		MergeOperator:   counterOperator{},
+		Clock:           func() time.Time { return time.Unix(0, now.Load()) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	tree.InsertWithTTL("counter", "10", time.Minute)
+	tree.Merge("counter", "1")
+	tree.Flush()
+	compact := func() {
+		t.Helper()
+		inputs := []LevelRange{{Level: 0, End: len(tree.segments[0])}, {Level: 1}}
+		if len(tree.segments) > 1 {
+			inputs[1].End = len(tree.segments[1])
+		}
+		err := tree.runCompaction(&Compaction{Inputs: inputs, OutputLevel: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	compact()
+
+	check := func(stage string, expected string) {
+		t.Helper()
+		valPtr, err := tree.Search("counter")
+		if err != nil || valPtr == nil || *valPtr != expected {
+			t.Errorf("Got %v, %v for counter %s (expected %s)", valPtr, err, stage, expected)
+		}
+	}
+	check("before expiry", "11")
+
+	// Whether or not compaction has run, operands apply to nothing once
+	// the value beneath them expires.
+	now.Add(int64(2 * time.Minute))
+	check("after expiry", "1")
+	compact()
+	check("after compacting the expired value", "1")
+	entries, err := tree.segments[1][0].Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := storage.EntryData{Key: "counter", Value: "1", Seq: 2}
+	if len(*entries) != 1 || (*entries)[0] != expected {
+		t.Errorf("Got %v after compaction (expected %v)", *entries, expected)
+	}
+}
+
+func TestMergeSearchDuringCompaction(t *testing.T) {
+	tree, err := New(&Settings{
+		CompactionLimit:      100000,
+		DataDirectory:        t.TempDir(),
+		LevelZeroMaxSegments: 10,
+		MergeOperator:        counterOperator{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	tree.Insert("counter", "1")
+	tree.Flush()
+	tree.Merge("counter", "2")
+	tree.Flush()
+	tree.Merge("counter", "3")
+	tree.Flush()
+
+	// Take the view a search would, then fold the operands into a single
+	// value before it reads the ones beneath the newest.
+	tree.mu.RLock()
+	view := tree.newView("counter")
+	tree.mu.RUnlock()
+	entry, err := view.get("counter", math.MaxUint64)
+	if err != nil || entry == nil || entry.Kind != storage.KindMerge {
+		t.Fatalf("Got %v, %v for the newest version (expected an operand)", entry, err)
+	}
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}, {Level: 1}},
+		OutputLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valPtr, err := tree.searchView(view, "counter", math.MaxUint64)
+	tree.releaseView(view)
+	if err != nil || valPtr == nil || *valPtr != "6" {
+		t.Errorf("Got %v, %v for counter during compaction (expected 6)", valPtr, err)
+	}
+	valPtr, err = tree.Search("counter")
+	if err != nil || valPtr == nil || *valPtr != "6" {
+		t.Errorf("Got %v, %v for counter after compaction (expected 6)", valPtr, err)
+	}
+}
+
+func TestMergeCompactionCrash(t *testing.T) {
+	settings := &Settings{
+		CompactionLimit:      100000,
+		DataDirectory:        t.TempDir(),
+		LevelZeroMaxSegments: 10,
+		MergeOperator:        counterOperator{},
+	}
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Insert("counter", "1")
+	tree.Flush()
+	tree.Merge("counter", "2")
+	tree.Flush()
+	tree.Merge("counter", "3")
+	tree.Flush()
+
+	// Keep the newest input, as though a crash stopped the compaction
+	// after the older inputs were removed.
+	newest := tree.segments[0][len(tree.segments[0])-1].FilePath
+	data, err := os.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}, {Level: 1}},
+		OutputLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Close()
+	err = os.WriteFile(newest, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	valPtr, err := tree.Search("counter")
+	if err != nil || valPtr == nil || *valPtr != "6" {
+		t.Errorf("Got %v, %v for counter after reopening (expected 6)", valPtr, err)
+	}
+	if _, err := os.Stat(newest); !os.IsNotExist(err) {
+		t.Errorf("Replaced input %s was not removed: %v", newest, err)
+	}
+}
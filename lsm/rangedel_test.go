@@ -0,0 +1,146 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	settings := &Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+	}
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys live in a segment and in the memtable when the range is deleted,
+	// and some are written again afterwards.
+	for i := range 50 {
+		tree.Insert(fmt.Sprintf("key%02d", i), "segment")
+	}
+	tree.Flush()
+	for i := 0; i < 50; i += 5 {
+		tree.Insert(fmt.Sprintf("key%02d", i), "memtable")
+	}
+	before := tree.Snapshot()
+	defer before.Release()
+	err = tree.DeleteRange("key10", "key30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Insert("key20", "after")
+	if tree.DeleteRange("b", "a") == nil {
+		t.Error("Deleted an empty range")
+	}
+
+	expected := make(map[string]string)
+	for i := range 50 {
+		value := "segment"
+		if i%5 == 0 {
+			value = "memtable"
+		}
+		if i < 10 || i >= 30 {
+			expected[fmt.Sprintf("key%02d", i)] = value
+		}
+	}
+	expected["key20"] = "after"
+
+	check := func(stage string) {
+		t.Helper()
+		for i := range 50 {
+			key := fmt.Sprintf("key%02d", i)
+			valPtr, err := tree.Search(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, ok := expected[key]
+			if (valPtr != nil) != ok || (ok && *valPtr != value) {
+				t.Errorf("Got %v for %s %s (expected %q)", valPtr, key, stage, value)
+			}
+		}
+		for _, reverse := range []bool{false, true} {
+			scan, scanErr := tree.Scan("key05", "key35")
+			if reverse {
+				scan, scanErr = tree.ScanReverse("key05", "key35")
+			}
+			found := 0
+			for key, value := range scan {
+				if value != expected[key] {
+					t.Errorf("Scanned %s=%s %s (expected %q)", key, value, stage, expected[key])
+				}
+				found++
+			}
+			if scanErr() != nil {
+				t.Fatal(scanErr())
+			}
+			// key05..key09, key20 and key30..key34.
+			if found != 11 {
+				t.Errorf("Scanned %d keys %s (expected 11)", found, stage)
+			}
+		}
+
+		valPtr, err := before.Search("key15")
+		if err != nil || valPtr == nil || *valPtr != "memtable" {
+			t.Errorf("Got %v, %v for key15 in snapshot %s", valPtr, err, stage)
+		}
+	}
+	check("in the memtable")
+
+	tree.Flush()
+	check("after flush")
+
+	// Compacting to the bottom level removes the deleted keys from disk,
+	// apart from the versions the snapshot still sees.
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}, {Level: 1}},
+		OutputLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+	before.Release()
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 1, End: len(tree.segments[1])}},
+		OutputLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tree.segments[1][0].Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range *entries {
+		if _, ok := expected[entry.Key]; !ok {
+			t.Errorf("Found deleted entry %v after compaction", entry)
+		}
+	}
+	if len(tree.segments[1][0].RangeDeletes()) != 0 {
+		t.Error("Expected the range delete to be dropped by the last compaction")
+	}
+	tree.Close()
+
+	// The range delete is also recovered from the log.
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Insert("key40", "replayed")
+	tree.DeleteRange("key40", "")
+	tree.Close()
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 40; i < 50; i++ {
+		valPtr, err := tree.Search(fmt.Sprintf("key%02d", i))
+		if err != nil || valPtr != nil {
+			t.Errorf("Got %v, %v for key%02d after replaying an unbounded range delete", valPtr, err, i)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package lsm
+
+import (
+	"bigsby/sstable"
+	"bigsby/storage"
+	"container/heap"
+	"iter"
+	"math"
+	"slices"
+)
+
+// A scanSource iterates over a sorted run of entries, yielding an error
+// and stopping if it cannot be read.
+type scanSource = iter.Seq2[storage.EntryData, error]
+
+type mergeItem struct {
+	entry storage.EntryData
+	// source is the index of the source the entry came from. Lower
+	// indexes hold newer data.
+	source int
+}
+
+// mergeHeap orders items by key, descending if reverse is set, and then
+// newest first.
+type mergeHeap struct {
+	items   []mergeItem
+	reverse bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if a.entry.Key != b.entry.Key {
+		return (a.entry.Key < b.entry.Key) != h.reverse
+	}
+	return a.source < b.source
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x any) { h.items = append(h.items, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// mergeSources k-way merges sources, ordered newest first, passing the
+// newest entry for each key to yield until it returns false. The sources
+// must all be in descending key order if reverse is set.
+func mergeSources(sources []scanSource, reverse bool, yield func(storage.EntryData) bool) error {
+	nexts := make([]func() (storage.EntryData, error, bool), len(sources))
+	for i, source := range sources {
+		next, stop := iter.Pull2(source)
+		defer stop()
+		nexts[i] = next
+	}
+
+	h := &mergeHeap{items: make([]mergeItem, 0, len(sources)), reverse: reverse}
+	advance := func(source int) error {
+		entry, err, ok := nexts[source]()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Push(h, mergeItem{entry: entry, source: source})
+		}
+		return nil
+	}
+	for i := range sources {
+		err := advance(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	for h.Len() > 0 {
+		item := heap.Pop(h).(mergeItem)
+		err := advance(item.source)
+		if err != nil {
+			return err
+		}
+		// Drop older entries for the same key.
+		for h.Len() > 0 && h.items[0].entry.Key == item.entry.Key {
+			shadowed := heap.Pop(h).(mergeItem)
+			err = advance(shadowed.source)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !yield(item.entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// memtableSource iterates over the newest version at or below seq of the
+// memtable keys in [start, end), in descending order if reverse is set. It
+// must not be used on a memtable that is still being written.
+func memtableSource(memtable *Memtable, start KeyType, end KeyType, reverse bool, seq uint64) scanSource {
+	if reverse {
+		return func(yield func(storage.EntryData, error) bool) {
+			entries := memtable.Reverse()
+			if end != "" {
+				entries = memtable.ReverseFrom(end)
+			}
+			for key, versions := range entries {
+				if key < start {
+					return
+				}
+				if key == end {
+					continue
+				}
+				entry := searchVersions(&versions, seq)
+				if entry != nil && !yield(*entry, nil) {
+					return
+				}
+			}
+		}
+	}
+
+	return func(yield func(storage.EntryData, error) bool) {
+		for key, versions := range memtable.InOrderFrom(start) {
+			if end != "" && key >= end {
+				return
+			}
+			entry := searchVersions(&versions, seq)
+			if entry != nil && !yield(*entry, nil) {
+				return
+			}
+		}
+	}
+}
+
+// visibleSource passes on the newest version at or below seq of each key
+// from a segment scan, which yields every version of a key together.
+func visibleSource(source scanSource, seq uint64) scanSource {
+	return func(yield func(storage.EntryData, error) bool) {
+		var visible *storage.EntryData
+		var key KeyType
+		for entry, err := range source {
+			if err != nil {
+				yield(storage.EntryData{}, err)
+				return
+			}
+			if entry.Key != key && visible != nil {
+				if !yield(*visible, nil) {
+					return
+				}
+				visible = nil
+			}
+			key = entry.Key
+			if entry.Seq <= seq && (visible == nil || entry.Seq > visible.Seq) {
+				visible = &entry
+			}
+		}
+		if visible != nil {
+			yield(*visible, nil)
+		}
+	}
+}
+
+// Scan iterates over the live keys in [start, end), in order. An empty end
+// means there is no upper bound. Writes made during the scan may or may not
+// be seen. After ranging over the scan, the returned function reports any
+// error that stopped it early.
+func (t *LSMTree) Scan(start KeyType, end KeyType) (iter.Seq2[KeyType, ValueType], func() error) {
+	return t.scan(start, end, false, nil, math.MaxUint64)
+}
+
+// ScanReverse iterates over the live keys in [start, end) in descending
+// order, as Scan does in ascending order.
+func (t *LSMTree) ScanReverse(start KeyType, end KeyType) (iter.Seq2[KeyType, ValueType], func() error) {
+	return t.scan(start, end, true, nil, math.MaxUint64)
+}
+
+// prefixEnd returns the smallest key after every key with the prefix, or
+// "" if there is none.
+func prefixEnd(prefix KeyType) KeyType {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return KeyType(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// ScanPrefix iterates over the live keys starting with prefix, in order, as
+// Scan does. If prefix is exactly what Settings.PrefixExtractor extracts
+// from its keys, segments whose filters rule the prefix out are skipped.
+func (t *LSMTree) ScanPrefix(prefix KeyType) (iter.Seq2[KeyType, ValueType], func() error) {
+	return t.scanPrefix(prefix, math.MaxUint64)
+}
+
+func (t *LSMTree) scanPrefix(prefix KeyType, seq uint64) (iter.Seq2[KeyType, ValueType], func() error) {
+	var skip func(*sstable.Table) bool
+	extractor := t.settings.PrefixExtractor
+	if extractor != nil {
+		if extracted, ok := extractor.Prefix(prefix); ok && extracted == prefix {
+			skip = func(segment *sstable.Table) bool {
+				return !segment.MayContainPrefix(extractor, prefix)
+			}
+		}
+	}
+	return t.scan(prefix, prefixEnd(prefix), false, skip, seq)
+}
+
+// scan merges the memtables and segments over [start, end) as of seq,
+// leaving out segments for which skip returns true. Their range deletes are
+// still applied, as they may cover keys in other segments.
+func (t *LSMTree) scan(start KeyType, end KeyType, reverse bool, skip func(*sstable.Table) bool, seq uint64) (iter.Seq2[KeyType, ValueType], func() error) {
+	var scanErr error
+	scan := func(yield func(KeyType, ValueType) bool) {
+		t.mu.RLock()
+		// Merge operands are applied from the same view the scan reads.
+		view := t.newView()
+		// The active memtable changes under writers, so copy its part of
+		// the range, along with the versions beneath any operands. The
+		// others are no longer written to.
+		active := make([]storage.EntryData, 0)
+		for entry := range memtableSource(t.memtable, start, end, reverse, seq) {
+			active = append(active, entry)
+			if entry.Kind == storage.KindMerge {
+				view.addActive(t.memtable, entry.Key)
+			}
+		}
+		rangeDels := slices.Clone(t.rangeDels)
+		sources := []scanSource{func(yield func(storage.EntryData, error) bool) {
+			for _, entry := range active {
+				if !yield(entry, nil) {
+					return
+				}
+			}
+		}}
+		for i := len(t.immutable) - 1; i >= 0; i-- {
+			sources = append(sources, memtableSource(t.immutable[i].memtable, start, end, reverse, seq))
+			rangeDels = append(rangeDels, t.immutable[i].rangeDels...)
+		}
+		t.mu.RUnlock()
+		defer t.releaseView(view)
+
+		for _, level := range view.segments {
+			for i := len(level) - 1; i >= 0; i-- {
+				rangeDels = append(rangeDels, level[i].RangeDeletes()...)
+				if skip != nil && skip(level[i]) {
+					continue
+				}
+				source := level[i].Scan(start, end)
+				if reverse {
+					source = level[i].ScanReverse(start, end)
+				}
+				sources = append(sources, visibleSource(source, seq))
+			}
+		}
+
+		// Only the range deletes that overlap the scan are checked.
+		rangeDels = slices.DeleteFunc(rangeDels, func(rangeDel storage.EntryData) bool {
+			return rangeDel.Seq > seq || (end != "" && rangeDel.Key >= end) || (rangeDel.Value != "" && rangeDel.Value <= start)
+		})
+		now := t.settings.Clock()
+		var mergeErr error
+		scanErr = mergeSources(sources, reverse, func(entry storage.EntryData) bool {
+			if entry.Kind == storage.KindDelete || entry.Expired(now) {
+				return true
+			}
+			if storage.NewestRangeDelete(rangeDels, entry.Key, seq) > entry.Seq {
+				return true
+			}
+			if entry.Kind == storage.KindMerge {
+				// Operands are applied with a lookup of the versions
+				// beneath them.
+				value, err := t.searchView(view, entry.Key, entry.Seq)
+				if err != nil {
+					mergeErr = err
+					return false
+				}
+				if value == nil {
+					return true
+				}
+				entry.Value = *value
+			}
+			return yield(entry.Key, entry.Value)
+		})
+		if scanErr == nil {
+			scanErr = mergeErr
+		}
+	}
+	return scan, func() error { return scanErr }
+}
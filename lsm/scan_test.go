@@ -0,0 +1,219 @@
+package lsm
+
+import (
+	"bigsby/sstable"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+)
+
+// newScanTree writes keys across several segments and the memtable, with
+// overwrites and removals in later layers, returning the live data.
+func newScanTree(t *testing.T) (*LSMTree, map[string]string) {
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tree.Close() })
+
+	expected := make(map[string]string)
+	insert := func(key string, value string) {
+		err := tree.Insert(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	remove := func(key string) {
+		err := tree.Remove(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+
+	for i := range 300 {
+		insert(fmt.Sprintf("key%03d", i), fmt.Sprintf("first%d", i))
+	}
+	tree.Flush()
+	for i := 0; i < 300; i += 3 {
+		insert(fmt.Sprintf("key%03d", i), fmt.Sprintf("second%d", i))
+	}
+	for i := 0; i < 300; i += 5 {
+		remove(fmt.Sprintf("key%03d", i))
+	}
+	tree.Flush()
+	for i := 0; i < 300; i += 7 {
+		insert(fmt.Sprintf("key%03d", i), fmt.Sprintf("third%d", i))
+	}
+	insert("key300", "past the end")
+	return tree, expected
+}
+
+func TestScan(t *testing.T) {
+	tree, expected := newScanTree(t)
+
+	for _, bounds := range [][2]string{
+		{"", ""},
+		{"key100", "key200"},
+		{"key0505", "key1"},
+		{"key250", ""},
+		{"key000", "key150"},
+		{"key010", "key101"},
+		{"key999", ""},
+	} {
+		start, end := bounds[0], bounds[1]
+		keys := make([]string, 0)
+		for key := range expected {
+			if key >= start && (end == "" || key < end) {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+
+		scan, scanErr := tree.Scan(start, end)
+		i := 0
+		for key, value := range scan {
+			if i >= len(keys) {
+				t.Errorf("Scanned unexpected key %s in [%s, %s)", key, start, end)
+				continue
+			}
+			if key != keys[i] || value != expected[key] {
+				t.Errorf("Scanned %s: %s (expected %s: %s)", key, value, keys[i], expected[keys[i]])
+			}
+			i++
+		}
+		if err := scanErr(); err != nil {
+			t.Fatal(err)
+		}
+		if i != len(keys) {
+			t.Errorf("Scanned %d keys in [%s, %s) (expected %d)", i, start, end, len(keys))
+		}
+
+		scan, scanErr = tree.ScanReverse(start, end)
+		for key, value := range scan {
+			if i <= 0 {
+				t.Errorf("Scanned unexpected key %s in reverse [%s, %s)", key, start, end)
+				continue
+			}
+			i--
+			if key != keys[i] || value != expected[key] {
+				t.Errorf("Scanned %s: %s in reverse (expected %s: %s)", key, value, keys[i], expected[keys[i]])
+			}
+		}
+		if err := scanErr(); err != nil {
+			t.Fatal(err)
+		}
+		if i != 0 {
+			t.Errorf("Reverse scan of [%s, %s) missed %d keys", start, end, i)
+		}
+	}
+}
+
+func TestScanStopEarly(t *testing.T) {
+	tree, _ := newScanTree(t)
+
+	scan, scanErr := tree.Scan("", "")
+	n := 0
+	for range scan {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	if err := scanErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping must release the segments.
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	for _, level := range tree.segments {
+		for _, segment := range level {
+			if segment.InUse() {
+				t.Errorf("Segment %s still in use after scan", segment.FilePath)
+			}
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	var data = []struct {
+		prefix, end string
+	}{
+		{"abc", "abd"},
+		{"ab\xff", "ac"},
+		{"\xff\xff", ""},
+		{"", ""},
+	}
+	for _, entry := range data {
+		if end := prefixEnd(entry.prefix); end != entry.end {
+			t.Errorf("Got end %q for prefix %q (expected %q)", end, entry.prefix, entry.end)
+		}
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   t.TempDir(),
+		PrefixExtractor: sstable.DelimitedPrefix{Delimiter: "/", Parts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// Each tenant's keys go to their own segment.
+	for tenant := range 3 {
+		for id := range 20 {
+			tree.Insert(fmt.Sprintf("tenant%d/%02d", tenant, id), fmt.Sprintf("%d-%d", tenant, id))
+		}
+		tree.Flush()
+	}
+	tree.Insert("tenant1/05", "updated")
+	tree.Remove("tenant1/06")
+	tree.Insert("tenant10/00", "other tenant")
+
+	scan, scanErr := tree.ScanPrefix("tenant1/")
+	keys := make([]string, 0)
+	for key, value := range scan {
+		if key == "tenant1/05" && value != "updated" {
+			t.Errorf("Scanned old value %s for %s", value, key)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanErr(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 19 || keys[0] != "tenant1/00" || keys[18] != "tenant1/19" || slices.Contains(keys, "tenant1/06") {
+		t.Errorf("Scanned unexpected keys for prefix tenant1/: %v", keys)
+	}
+
+	// The filters rule out the other tenants' segments, so they are never
+	// opened.
+	tree.mu.RLock()
+	for _, segment := range tree.segments[0] {
+		if segment.MayContainPrefix(tree.settings.PrefixExtractor, "tenant1/") {
+			continue
+		}
+		os.Remove(segment.FilePath)
+	}
+	tree.mu.RUnlock()
+
+	scan, scanErr = tree.ScanPrefix("tenant1/")
+	n := 0
+	for range scan {
+		n++
+	}
+	if err := scanErr(); err != nil {
+		t.Errorf("Scan opened segment without prefix: %v", err)
+	}
+	if n != 19 {
+		t.Errorf("Scanned %d keys for prefix tenant1/ (expected 19)", n)
+	}
+}
@@ -0,0 +1,65 @@
+package lsm
+
+import (
+	"iter"
+	"slices"
+)
+
+// Snapshot is a consistent view of the tree as of the moment it was taken.
+// Later writes are not visible through it, and compaction keeps the
+// versions it can see until it is released.
+type Snapshot struct {
+	tree     *LSMTree
+	seq      uint64
+	released bool
+}
+
+// Snapshot returns a view of the tree's current contents. It must be
+// released when no longer needed, so older versions can be discarded.
+func (t *LSMTree) Snapshot() *Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i, _ := slices.BinarySearch(t.snapshots, t.seq)
+	t.snapshots = slices.Insert(t.snapshots, i, t.seq)
+	return &Snapshot{tree: t, seq: t.seq}
+}
+
+// Seq returns the sequence number of the last write the snapshot sees.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+func (s *Snapshot) Search(key KeyType) (*ValueType, error) {
+	return s.tree.search(key, s.seq)
+}
+
+// Scan, ScanReverse and ScanPrefix behave as the LSMTree methods of the
+// same names, over the snapshot.
+func (s *Snapshot) Scan(start KeyType, end KeyType) (iter.Seq2[KeyType, ValueType], func() error) {
+	return s.tree.scan(start, end, false, nil, s.seq)
+}
+
+func (s *Snapshot) ScanReverse(start KeyType, end KeyType) (iter.Seq2[KeyType, ValueType], func() error) {
+	return s.tree.scan(start, end, true, nil, s.seq)
+}
+
+func (s *Snapshot) ScanPrefix(prefix KeyType) (iter.Seq2[KeyType, ValueType], func() error) {
+	return s.tree.scanPrefix(prefix, s.seq)
+}
+
+// Release ends the snapshot. It must not be used afterwards.
+func (s *Snapshot) Release() {
+	t := s.tree
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	i, found := slices.BinarySearch(t.snapshots, s.seq)
+	if found {
+		t.snapshots = slices.Delete(t.snapshots, i, i+1)
+	}
+}
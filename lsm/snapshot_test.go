@@ -0,0 +1,177 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+)
+
+// checkSnapshot verifies that every key0..key9 has the expected value, or is
+// absent if there is none, through both Search and Scan.
+func checkSnapshot(t *testing.T, snapshot *Snapshot, expected map[string]string) {
+	t.Helper()
+	for i := range 10 {
+		key := fmt.Sprintf("key%d", i)
+		valPtr, err := snapshot.Search(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, ok := expected[key]
+		if (valPtr != nil) != ok || (ok && *valPtr != value) {
+			t.Errorf("Got %v for %s in snapshot %d (expected %q)", valPtr, key, snapshot.Seq(), value)
+		}
+	}
+
+	scan, scanErr := snapshot.Scan("", "")
+	found := 0
+	for key, value := range scan {
+		if value != expected[key] {
+			t.Errorf("Scanned %s=%s in snapshot %d (expected %q)", key, value, snapshot.Seq(), expected[key])
+		}
+		found++
+	}
+	if scanErr() != nil {
+		t.Fatal(scanErr())
+	}
+	if found != len(expected) {
+		t.Errorf("Scanned %d keys in snapshot %d (expected %d)", found, snapshot.Seq(), len(expected))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := range 10 {
+		tree.Insert(fmt.Sprintf("key%d", i), "first")
+	}
+	first := tree.Snapshot()
+	firstExpected := make(map[string]string)
+	for i := range 10 {
+		firstExpected[fmt.Sprintf("key%d", i)] = "first"
+	}
+
+	for i := 0; i < 10; i += 2 {
+		tree.Insert(fmt.Sprintf("key%d", i), "second")
+	}
+	tree.Remove("key1")
+	second := tree.Snapshot()
+	defer second.Release()
+	secondExpected := make(map[string]string)
+	for key, value := range firstExpected {
+		secondExpected[key] = value
+	}
+	for i := 0; i < 10; i += 2 {
+		secondExpected[fmt.Sprintf("key%d", i)] = "second"
+	}
+	delete(secondExpected, "key1")
+
+	tree.Insert("key0", "third")
+	tree.Remove("key2")
+
+	checkSnapshot(t, first, firstExpected)
+	checkSnapshot(t, second, secondExpected)
+
+	// Versions must survive being flushed and compacted while the
+	// snapshots can see them.
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, first, firstExpected)
+	checkSnapshot(t, second, secondExpected)
+
+	tree.Insert("key3", "fourth")
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}},
+		OutputLevel: 0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, first, firstExpected)
+	checkSnapshot(t, second, secondExpected)
+
+	valPtr, err := tree.Search("key3")
+	if err != nil || valPtr == nil || *valPtr != "fourth" {
+		t.Errorf("Got %v, %v for key3 (expected fourth)", valPtr, err)
+	}
+	valPtr, err = tree.Search("key2")
+	if err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v for removed key2", valPtr, err)
+	}
+
+	// Once released, compaction drops the versions only it could see.
+	first.Release()
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}},
+		OutputLevel: 0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tree.segments[0][0].Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for _, entry := range *entries {
+		if entry.Value != "first" {
+			continue
+		}
+		if secondExpected[entry.Key] != "first" {
+			t.Errorf("Found version %v that no snapshot can see", entry)
+		}
+		kept++
+	}
+	if kept != 4 {
+		t.Errorf("Kept %d first versions (expected 4)", kept)
+	}
+	checkSnapshot(t, second, secondExpected)
+}
+
+func TestSequenceRecovery(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Insert("hello", "world")
+	tree.Flush()
+	tree.Insert("good", "bye")
+	seq := tree.Snapshot().Seq()
+	tree.Close()
+
+	// The new tree must carry on after both the flushed and logged writes.
+	tree, err = New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	snapshot := tree.Snapshot()
+	defer snapshot.Release()
+	if snapshot.Seq() != seq {
+		t.Errorf("Recovered seq %d (expected %d)", snapshot.Seq(), seq)
+	}
+	tree.Insert("hello", "there")
+	valPtr, err := snapshot.Search("hello")
+	if err != nil || valPtr == nil || *valPtr != "world" {
+		t.Errorf("Got %v, %v for hello in snapshot (expected world)", valPtr, err)
+	}
+}
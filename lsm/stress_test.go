@@ -0,0 +1,182 @@
+package lsm
+
+import (
+	"bigsby/wal"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// These tests are most useful under the race detector (go test -race).
+
+func newStressTree(t *testing.T, mode wal.SyncMode) *LSMTree {
+	tree, err := New(
+		&Settings{
+			CompactionLimit:      200,
+			DataDirectory:        t.TempDir(),
+			LevelZeroMaxSegments: 2,
+			SyncMode:             mode,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	tree := newStressTree(t, wal.SyncGroupCommit)
+	defer tree.Close()
+
+	writers, keysPerWriter, rounds := 4, 20, 10
+	var writersDone sync.WaitGroup
+	done := make(chan struct{})
+
+	for w := range writers {
+		writersDone.Add(1)
+		go func() {
+			defer writersDone.Done()
+			for round := range rounds {
+				for k := range keysPerWriter {
+					err := tree.Insert(fmt.Sprintf("w%d-k%02d", w, k), strconv.Itoa(round))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// Each key only moves forward through the rounds, so a reader must
+	// never see a value older than one it has already seen.
+	var readers sync.WaitGroup
+	for r := range writers {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			seen := make(map[string]int)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("w%d-k%02d", r, len(seen)%keysPerWriter)
+				valPtr, err := tree.Search(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if valPtr == nil {
+					continue
+				}
+				round, _ := strconv.Atoi(*valPtr)
+				if round < seen[key] {
+					t.Errorf("Read %s=%d after reading %d", key, round, seen[key])
+				}
+				seen[key] = round
+			}
+		}()
+	}
+
+	// Scans run alongside the writes and must stay in key order.
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			scan, scanErr := tree.Scan("", "")
+			last := ""
+			for key := range scan {
+				if key <= last {
+					t.Errorf("Scanned %s after %s", key, last)
+				}
+				last = key
+			}
+			if err := scanErr(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	writersDone.Wait()
+	close(done)
+	readers.Wait()
+
+	for w := range writers {
+		for k := range keysPerWriter {
+			valPtr, err := tree.Search(fmt.Sprintf("w%d-k%02d", w, k))
+			if err != nil {
+				t.Error(err)
+			}
+			if valPtr == nil || *valPtr != strconv.Itoa(rounds-1) {
+				t.Errorf("Expected final value for w%d-k%02d", w, k)
+			}
+		}
+	}
+}
+
+func TestConcurrentFlushCompact(t *testing.T) {
+	tree := newStressTree(t, wal.SyncInterval)
+	defer tree.Close()
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				key := fmt.Sprintf("w%d-%03d", w, i)
+				err := tree.Insert(key, "value")
+				if err != nil {
+					t.Error(err)
+				}
+				if i%10 == 0 {
+					err = tree.Remove(key)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 10 {
+			if err := tree.Flush(); err != nil {
+				t.Error(err)
+			}
+			if err := tree.Compact(); err != nil {
+				t.Error(err)
+			}
+			tree.PrintMemtable(io.Discard)
+			tree.PrintSegments(io.Discard)
+		}
+	}()
+	wg.Wait()
+
+	for w := range 4 {
+		for i := range 50 {
+			valPtr, err := tree.Search(fmt.Sprintf("w%d-%03d", w, i))
+			if err != nil {
+				t.Error(err)
+			}
+			if i%10 == 0 && valPtr != nil {
+				t.Errorf("Expected w%d-%03d to be removed", w, i)
+			}
+			if i%10 != 0 && valPtr == nil {
+				t.Errorf("Could not find w%d-%03d", w, i)
+			}
+		}
+	}
+}
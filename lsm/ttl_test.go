@@ -0,0 +1,95 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInsertWithTTL(t *testing.T) {
+	var now atomic.Int64
+	now.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	settings := &Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   t.TempDir(),
+		Clock:           func() time.Time { return time.Unix(0, now.Load()) },
+	}
+	tree, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.InsertWithTTL("bad", "ttl", 0) == nil {
+		t.Error("Inserted with a zero TTL")
+	}
+	tree.Insert("session", "old")
+	tree.Flush()
+	err = tree.InsertWithTTL("session", "new", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.InsertWithTTL("short", "lived", time.Second)
+	tree.Insert("forever", "value")
+
+	check := func(stage string, expected map[string]string) {
+		t.Helper()
+		for _, key := range []string{"session", "short", "forever"} {
+			valPtr, err := tree.Search(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, ok := expected[key]
+			if (valPtr != nil) != ok || (ok && *valPtr != value) {
+				t.Errorf("Got %v for %s %s (expected %q)", valPtr, key, stage, value)
+			}
+		}
+		scan, scanErr := tree.Scan("", "")
+		found := 0
+		for key, value := range scan {
+			if value != expected[key] {
+				t.Errorf("Scanned %s=%s %s (expected %q)", key, value, stage, expected[key])
+			}
+			found++
+		}
+		if scanErr() != nil {
+			t.Fatal(scanErr())
+		}
+		if found != len(expected) {
+			t.Errorf("Scanned %d keys %s (expected %d)", found, stage, len(expected))
+		}
+	}
+	check("before expiry", map[string]string{"session": "new", "short": "lived", "forever": "value"})
+
+	// The expiry is kept in the log.
+	tree.Close()
+	tree, err = New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	now.Add(int64(2 * time.Second))
+	check("after the short TTL", map[string]string{"session": "new", "forever": "value"})
+
+	// Expired values must not uncover older ones.
+	now.Add(int64(time.Minute))
+	check("after both TTLs", map[string]string{"forever": "value"})
+	tree.Flush()
+	check("after flush", map[string]string{"forever": "value"})
+
+	err = tree.runCompaction(&Compaction{
+		Inputs:      []LevelRange{{Level: 0, End: len(tree.segments[0])}, {Level: 1}},
+		OutputLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction", map[string]string{"forever": "value"})
+	entries, err := tree.segments[1][0].Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*entries) != 1 || (*entries)[0].Key != "forever" {
+		t.Errorf("Got %v after compaction (expected only the entry without a TTL)", *entries)
+	}
+}
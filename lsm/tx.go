@@ -0,0 +1,200 @@
+package lsm
+
+import (
+	"bigsby/sstable"
+	"bigsby/storage"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ConflictError is returned by Commit when a key the transaction read was
+// written by someone else after the transaction began.
+type ConflictError struct {
+	Key KeyType
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Transaction conflict on key %s", e.Key)
+}
+
+// Tx is an optimistic transaction. Reads see the tree as of BeginTx, along
+// with the transaction's own writes, which are buffered until Commit. A Tx
+// is not safe for concurrent use.
+type Tx struct {
+	tree     *LSMTree
+	snapshot *Snapshot
+	batch    WriteBatch
+	// writes holds the latest buffered put or delete of each key, and
+	// operands the merge operands buffered after it, oldest first.
+	writes   map[KeyType]storage.EntryData
+	operands map[KeyType][]string
+	reads    map[KeyType]struct{}
+	done     bool
+}
+
+// BeginTx starts a transaction. It must be finished with Commit or Rollback.
+func (t *LSMTree) BeginTx() *Tx {
+	return &Tx{
+		tree:     t,
+		snapshot: t.Snapshot(),
+		writes:   make(map[KeyType]storage.EntryData),
+		operands: make(map[KeyType][]string),
+		reads:    make(map[KeyType]struct{}),
+	}
+}
+
+func (tx *Tx) Get(key KeyType) (*ValueType, error) {
+	if tx.done {
+		return nil, fmt.Errorf("Transaction already finished")
+	}
+	var existing *ValueType
+	if entry, ok := tx.writes[key]; ok {
+		if entry.Kind == storage.KindPut {
+			existing = &entry.Value
+		}
+	} else {
+		tx.reads[key] = struct{}{}
+		var err error
+		existing, err = tx.snapshot.Search(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tx.tree.applyOperands(key, existing, tx.operands[key])
+}
+
+func (tx *Tx) Put(key KeyType, value ValueType) {
+	tx.batch.Put(key, value)
+	tx.writes[key] = storage.EntryData{Key: key, Value: value}
+	delete(tx.operands, key)
+}
+
+func (tx *Tx) Delete(key KeyType) {
+	tx.batch.Delete(key)
+	tx.writes[key] = storage.EntryData{Key: key, Kind: storage.KindDelete}
+	delete(tx.operands, key)
+}
+
+// Merge buffers a merge operand for key, as LSMTree.Merge writes one. It
+// does not read the key, so it cannot make Commit conflict.
+func (tx *Tx) Merge(key KeyType, operand string) {
+	tx.batch.Merge(key, operand)
+	tx.operands[key] = append(tx.operands[key], operand)
+}
+
+// Commit applies the transaction's writes atomically. It fails with a
+// *ConflictError, writing nothing, if any key read through Get has been
+// written since the transaction began.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("Transaction already finished")
+	}
+	defer tx.Rollback()
+
+	for {
+		checked, err := tx.checkReads()
+		if err != nil {
+			return err
+		}
+		err = tx.tree.write(&tx.batch, func() error {
+			return tx.recheckReads(checked)
+		})
+		if err != errRecheckReads {
+			return err
+		}
+	}
+}
+
+// Rollback discards the transaction's writes. It does nothing once the
+// transaction has finished.
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.snapshot.Release()
+}
+
+// errRecheckReads sends Commit back to check its reads again, when segments
+// holding writes it has not checked were installed while it was checking.
+var errRecheckReads = errors.New("Transaction reads need checking again")
+
+// checkReads fails with a *ConflictError if a key the transaction read has
+// been written since it began, and returns the sequence number of the last
+// write it checked. Segments are read without holding mu, so readers and
+// writers are not held up by the disk.
+func (tx *Tx) checkReads() (uint64, error) {
+	t := tx.tree
+	t.mu.RLock()
+	checked := t.seq
+	inSegments := make([]KeyType, 0)
+	for key := range tx.reads {
+		entry := t.searchMemtables(key, math.MaxUint64)
+		if entry == nil {
+			inSegments = append(inSegments, key)
+		} else if entry.Seq > tx.snapshot.seq {
+			t.mu.RUnlock()
+			return 0, &ConflictError{Key: key}
+		}
+	}
+	segments := t.refSegments()
+	t.mu.RUnlock()
+	defer t.unrefSegments(segments)
+
+	for _, key := range inSegments {
+		modified, err := modifiedSince(segments, key, tx.snapshot.seq)
+		if err != nil {
+			return 0, err
+		}
+		if modified {
+			return 0, &ConflictError{Key: key}
+		}
+	}
+	return checked, nil
+}
+
+// recheckReads checks the writes made after checked, which are still in the
+// memtables unless a segment holding them has been installed since. Must be
+// called with mu held.
+func (tx *Tx) recheckReads(checked uint64) error {
+	t := tx.tree
+	if t.seq == checked {
+		return nil
+	}
+	for _, level := range t.segments {
+		for _, segment := range level {
+			if segment.MaxSeq() > checked {
+				return errRecheckReads
+			}
+		}
+	}
+	for key := range tx.reads {
+		entry := t.searchMemtables(key, math.MaxUint64)
+		if entry != nil && entry.Seq > tx.snapshot.seq {
+			return &ConflictError{Key: key}
+		}
+	}
+	return nil
+}
+
+// modifiedSince reports whether key has been written after seq in
+// segments, which the caller holds references to.
+func modifiedSince(segments [][]*sstable.Table, key KeyType, seq uint64) (bool, error) {
+	// Only segments flushed since seq can hold a newer write.
+	for _, level := range segments {
+		for _, segment := range level {
+			if segment.MaxSeq() <= seq {
+				continue
+			}
+			entry, err := segment.Get(key, math.MaxUint64)
+			if err != nil {
+				return false, err
+			}
+			if entry != nil && entry.Seq > seq {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
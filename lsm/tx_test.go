@@ -0,0 +1,172 @@
+package lsm
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTxTree(t *testing.T) *LSMTree {
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tree.Close() })
+	return tree
+}
+
+func TestTxCommit(t *testing.T) {
+	tree := newTxTree(t)
+	tree.Insert("balance", "10")
+	tree.Insert("other", "x")
+
+	tx := tree.BeginTx()
+	valPtr, err := tx.Get("balance")
+	if err != nil || valPtr == nil || *valPtr != "10" {
+		t.Fatalf("Got %v, %v for balance", valPtr, err)
+	}
+	tx.Put("balance", "20")
+	tx.Delete("other")
+
+	// The transaction sees its own writes, and nobody else does yet.
+	valPtr, err = tx.Get("balance")
+	if err != nil || valPtr == nil || *valPtr != "20" {
+		t.Errorf("Got %v, %v for balance written in transaction", valPtr, err)
+	}
+	valPtr, err = tx.Get("other")
+	if err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v for other deleted in transaction", valPtr, err)
+	}
+	valPtr, err = tree.Search("balance")
+	if err != nil || valPtr == nil || *valPtr != "10" {
+		t.Errorf("Got %v, %v for balance before commit", valPtr, err)
+	}
+
+	// Writes to keys the transaction did not read do not conflict.
+	tree.Insert("unrelated", "y")
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valPtr, err = tree.Search("balance")
+	if err != nil || valPtr == nil || *valPtr != "20" {
+		t.Errorf("Got %v, %v for balance after commit", valPtr, err)
+	}
+	valPtr, err = tree.Search("other")
+	if err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v for other after commit", valPtr, err)
+	}
+
+	if tx.Commit() == nil {
+		t.Error("Committed a finished transaction")
+	}
+	if len(tree.snapshots) != 0 {
+		t.Errorf("Transaction left %d snapshots behind", len(tree.snapshots))
+	}
+}
+
+func TestTxConflict(t *testing.T) {
+	tree := newTxTree(t)
+	tree.Insert("counter", "1")
+
+	for _, flush := range []bool{false, true} {
+		tx := tree.BeginTx()
+		_, err := tx.Get("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx.Get("missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Put("counter", "from tx")
+
+		// A write after the transaction began, which may have been
+		// flushed to a segment by the time it commits.
+		tree.Insert("missing", "now here")
+		if flush {
+			tree.Flush()
+		}
+
+		err = tx.Commit()
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || conflict.Key != "missing" {
+			t.Fatalf("Got %v committing a conflicting transaction", err)
+		}
+		valPtr, err := tree.Search("counter")
+		if err != nil || valPtr == nil || *valPtr != "1" {
+			t.Errorf("Got %v, %v for counter after failed commit", valPtr, err)
+		}
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	tree := newTxTree(t)
+
+	tx := tree.BeginTx()
+	tx.Put("hello", "world")
+	tx.Rollback()
+	tx.Rollback()
+
+	valPtr, err := tree.Search("hello")
+	if err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v for key written by rolled back transaction", valPtr, err)
+	}
+	if _, err := tx.Get("hello"); err == nil {
+		t.Error("Read from a rolled back transaction")
+	}
+	if len(tree.snapshots) != 0 {
+		t.Errorf("Transaction left %d snapshots behind", len(tree.snapshots))
+	}
+}
+
+func TestTxMerge(t *testing.T) {
+	tree, err := New(&Settings{
+		CompactionLimit: 100000,
+		DataDirectory:   t.TempDir(),
+		MergeOperator:   counterOperator{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	tree.Insert("counter", "10")
+
+	// Merges do not read the key, so other writes to it do not conflict.
+	tx := tree.BeginTx()
+	tx.Merge("counter", "5")
+	tree.Merge("counter", "1")
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valPtr, err := tree.Search("counter")
+	if err != nil || valPtr == nil || *valPtr != "16" {
+		t.Errorf("Got %v, %v for counter after commit", valPtr, err)
+	}
+
+	// The transaction sees its own operands.
+	tx = tree.BeginTx()
+	tx.Merge("counter", "4")
+	valPtr, err = tx.Get("counter")
+	if err != nil || valPtr == nil || *valPtr != "20" {
+		t.Errorf("Got %v, %v for counter merged in transaction", valPtr, err)
+	}
+	tx.Put("counter", "0")
+	tx.Merge("counter", "3")
+	valPtr, err = tx.Get("counter")
+	if err != nil || valPtr == nil || *valPtr != "3" {
+		t.Errorf("Got %v, %v for counter put and merged in transaction", valPtr, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valPtr, err = tree.Search("counter")
+	if err != nil || valPtr == nil || *valPtr != "3" {
+		t.Errorf("Got %v, %v for counter after second commit", valPtr, err)
+	}
+}
@@ -114,6 +114,76 @@ func (t *Tree[K, V]) InOrder() iter.Seq2[K, V] {
 	}
 }
 
+func inOrderFromIter[K cmp.Ordered, V any](node *Node[K, V], start K, yield func(K, V) bool) bool {
+	if node == nil {
+		return true
+	}
+	// Only the left subtree of a node before start is skipped entirely.
+	if start < node.Key {
+		if !inOrderFromIter(node.Children[Left], start, yield) {
+			return false
+		}
+	}
+	if start <= node.Key {
+		if !yield(node.Key, node.Value) {
+			return false
+		}
+	}
+	return inOrderFromIter(node.Children[Right], start, yield)
+}
+
+// InOrderFrom iterates over the keys at or after start, in order.
+func (t *Tree[K, V]) InOrderFrom(start K) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		inOrderFromIter(t.Root, start, yield)
+	}
+}
+
+func reverseIter[K cmp.Ordered, V any](node *Node[K, V], yield func(K, V) bool) bool {
+	if node == nil {
+		return true
+	}
+	if !reverseIter(node.Children[Right], yield) {
+		return false
+	}
+	if !yield(node.Key, node.Value) {
+		return false
+	}
+	return reverseIter(node.Children[Left], yield)
+}
+
+// Reverse iterates over the keys in descending order.
+func (t *Tree[K, V]) Reverse() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		reverseIter(t.Root, yield)
+	}
+}
+
+func reverseFromIter[K cmp.Ordered, V any](node *Node[K, V], start K, yield func(K, V) bool) bool {
+	if node == nil {
+		return true
+	}
+	if node.Key < start {
+		if !reverseFromIter(node.Children[Right], start, yield) {
+			return false
+		}
+	}
+	if node.Key <= start {
+		if !yield(node.Key, node.Value) {
+			return false
+		}
+	}
+	return reverseFromIter(node.Children[Left], start, yield)
+}
+
+// ReverseFrom iterates over the keys at or before start, in descending
+// order.
+func (t *Tree[K, V]) ReverseFrom(start K) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		reverseFromIter(t.Root, start, yield)
+	}
+}
+
 func (n *Node[K, V]) Direction() Direction {
 	if n == n.Parent.Children[Left] {
 		return Left
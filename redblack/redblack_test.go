@@ -119,3 +119,51 @@ func TestManyRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestInOrderFrom(t *testing.T) {
+	tree := Tree[int, int]{}
+	for i := range 100 {
+		tree.Insert(i*2, i)
+	}
+
+	for _, start := range []int{-1, 0, 51, 100, 198, 199} {
+		expected := max(start+start%2, 0)
+		for key, value := range tree.InOrderFrom(start) {
+			if key != expected || value != key/2 {
+				t.Errorf("Got %d: %d from %d (expected %d: %d)", key, value, start, expected, expected/2)
+			}
+			expected += 2
+		}
+		if expected < 200 {
+			t.Errorf("Iteration from %d stopped early before %d", start, expected)
+		}
+	}
+}
+
+func TestReverseFrom(t *testing.T) {
+	tree := Tree[int, int]{}
+	for i := range 100 {
+		tree.Insert(i*2, i)
+	}
+
+	expected := 198
+	for key := range tree.Reverse() {
+		if key != expected {
+			t.Errorf("Got %d in reverse (expected %d)", key, expected)
+		}
+		expected -= 2
+	}
+
+	for _, start := range []int{-1, 0, 51, 100, 198, 250} {
+		expected := min(start&^1, 198)
+		for key, value := range tree.ReverseFrom(start) {
+			if key != expected || value != key/2 {
+				t.Errorf("Got %d: %d from %d (expected %d: %d)", key, value, start, expected, expected/2)
+			}
+			expected -= 2
+		}
+		if expected >= 0 {
+			t.Errorf("Reverse iteration from %d stopped early before %d", start, expected)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package repl
 
 import (
+	"bigsby/bloom"
 	"bigsby/lsm"
+	"bigsby/sstable"
+	"bigsby/wal"
 	"bufio"
 	"flag"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 )
 
@@ -54,6 +58,48 @@ func remove(db *lsm.LSMTree, out io.Writer, args ...string) error {
 	return nil
 }
 
+func removeRange(db *lsm.LSMTree, out io.Writer, args ...string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Not enough arguments (expected 1 or 2).")
+	}
+	start, end := args[0], ""
+	if len(args) > 1 {
+		end = args[1]
+	}
+	err := db.DeleteRange(start, end)
+	if err != nil {
+		return err
+	}
+	io.WriteString(out, fmt.Sprintf("Removed keys in [%s, %s)\n", start, end))
+	return nil
+}
+
+func scanPrefix(db *lsm.LSMTree, out io.Writer, args ...string) error {
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	limit := -1
+	if len(args) > 1 {
+		var err error
+		limit, err = strconv.Atoi(args[1])
+		if err != nil || limit < 0 {
+			return fmt.Errorf("Invalid limit %s.", args[1])
+		}
+	}
+
+	scan, scanErr := db.ScanPrefix(prefix)
+	count := 0
+	for key, value := range scan {
+		if count == limit {
+			break
+		}
+		io.WriteString(out, fmt.Sprintf("[%s, %s]\n", key, value))
+		count++
+	}
+	return scanErr()
+}
+
 func flush(db *lsm.LSMTree, out io.Writer) error {
 	err := db.Flush()
 	if err != nil {
@@ -87,15 +133,61 @@ func Start(in io.Reader, out io.Writer) {
 
 	dataDirPtr := flag.String("data-dir", "./.bigsby", "Directory to store data.")
 	compactionLimitPtr := flag.Int("compaction-limit", 1000, "Limit (bytes) for compaction")
+	compactionPtr := flag.String("compaction", "leveled", "Compaction strategy (leveled or size-tiered)")
+	syncModePtr := flag.String("sync-mode", "always", "When to sync the log (always, group or interval)")
+	syncIntervalPtr := flag.Duration("sync-interval", wal.DefaultSyncInterval, "Log sync period for interval sync mode")
+	compressionPtr := flag.String("compression", "none", "Segment block compression (none, snappy or flate)")
+	bloomRatePtr := flag.Float64("bloom-fp-rate", bloom.DefaultFalsePositiveRate, "False positive rate to size segment bloom filters for")
+	bloomHashPtr := flag.String("bloom-hash", bloom.DefaultHash.String(), "Hash for segment bloom filters (murmur3 or xxhash64)")
+	bloomBlockedPtr := flag.Bool("bloom-blocked", false, "Use cache-line blocked bloom filters for segments")
+	prefixDelimiterPtr := flag.String("prefix-delimiter", "", "Add key prefixes up to this delimiter to segment bloom filters")
 	flag.Parse()
 
+	syncMode, err := wal.ParseSyncMode(*syncModePtr)
+	if err != nil {
+		panic(err)
+	}
+
+	compression, err := sstable.ParseCompression(*compressionPtr)
+	if err != nil {
+		panic(err)
+	}
+
+	bloomHash, err := bloom.ParseHash(*bloomHashPtr)
+	if err != nil {
+		panic(err)
+	}
+
+	var prefixExtractor sstable.PrefixExtractor
+	if *prefixDelimiterPtr != "" {
+		prefixExtractor = sstable.DelimitedPrefix{Delimiter: *prefixDelimiterPtr, Parts: 1}
+	}
+
+	var strategy lsm.CompactionStrategy
+	switch *compactionPtr {
+	case "leveled":
+	case "size-tiered":
+		strategy = lsm.NewSizeTieredCompaction()
+	default:
+		panic(fmt.Sprintf("Unknown compaction strategy %s", *compactionPtr))
+	}
+
 	db, err := lsm.New(&lsm.Settings{
-		CompactionLimit: *compactionLimitPtr,
-		DataDirectory:   *dataDirPtr,
+		CompactionLimit:        *compactionLimitPtr,
+		DataDirectory:          *dataDirPtr,
+		SyncMode:               syncMode,
+		SyncInterval:           *syncIntervalPtr,
+		CompactionStrategy:     strategy,
+		Compression:            compression,
+		BloomFalsePositiveRate: *bloomRatePtr,
+		BloomHash:              bloomHash,
+		BlockedBloomFilter:     *bloomBlockedPtr,
+		PrefixExtractor:        prefixExtractor,
 	})
 	if err != nil {
 		panic(fmt.Sprintf("Could not create db: %v", err))
 	}
+	defer db.Close()
 	defer db.Flush()
 
 	io.WriteString(out, "Running BigsbyDB\n")
@@ -120,6 +212,10 @@ func Start(in io.Reader, out io.Writer) {
 			err = search(db, out, args...)
 		case "remove", "r":
 			err = remove(db, out, args...)
+		case "removerange", "rr":
+			err = removeRange(db, out, args...)
+		case "scan", "prefix":
+			err = scanPrefix(db, out, args...)
 		case "print", "p":
 			err = printObject(db, out, args...)
 		case "flush", "f":
@@ -0,0 +1,702 @@
+package sstable
+
+import (
+	"bigsby/bloom"
+	"bigsby/storage"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Format 2 segments group entries into data blocks of roughly blockSize
+// bytes, followed by a filter block, an index block and a metaindex block,
+// and end with a fixed size footer:
+//
+//	header:    cookie + version
+//	data:      block of encoded entries, repeated
+//	filter:    bloom filter over every key
+//	index:     first key + handle of each data block
+//	metaindex: name + handle of each meta block (currently the filter)
+//	footer:    metaindex handle + index handle + magic
+//
+// A handle is the offset and length of a block in the file.
+//
+// Format 3 adds CRC32C checksums: the header and footer each end with a
+// checksum of their contents (before the footer magic), and every block is
+// followed by a trailer holding the checksum of the block. Handles do not
+// include the trailer.
+//
+// Format 4 allows data blocks to be compressed. The trailer starts with a
+// byte giving the block's Compression, and its checksum covers the stored
+// block and that byte. Handles give the stored length.
+//
+// Format 5 entries carry sequence numbers. A key may have several entries,
+// newest first, which always share a data block. A meta block records the
+// highest sequence number in the segment.
+//
+// Format 6 entries carry a storage.Kind, so deletes are no longer stored
+// as storage.Tombstone values.
+//
+// Format 7 segments may hold range deletes, which are kept out of the data
+// blocks in a meta block of their own.
+//
+// Format 8 entries may carry an expiry time, flagged in their kind byte.
+//
+// Format 9 entries may be storage.KindMerge operands.
+//
+// Format 10 segments record how many keys their filter holds, and merged
+// segments name the segments they replace, each in a meta block. Older
+// versions would ignore the replaced names and load the inputs a crash
+// left behind, so these segments are not readable by them.
+
+const blockSize = 4096
+const footerMagic uint64 = 0xb165b7b1e5e6e472
+const checksumLen = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+// CorruptionError reports segment data that failed validation.
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Corrupt segment %s at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+func hasChecksums(version uint16) bool {
+	return version >= 3
+}
+
+func hasCompression(version uint16) bool {
+	return version >= 4
+}
+
+func hasSequenceNumbers(version uint16) bool {
+	return version >= 5
+}
+
+func hasEntryKinds(version uint16) bool {
+	return version >= 6
+}
+
+func trailerLen(version uint16) int64 {
+	switch {
+	case hasCompression(version):
+		return 1 + checksumLen
+	case hasChecksums(version):
+		return checksumLen
+	default:
+		return 0
+	}
+}
+
+func footerLen(version uint16) int64 {
+	if hasChecksums(version) {
+		return 4*8 + checksumLen + 8
+	}
+	return 4*8 + 8
+}
+
+// Segments written before filters were sized from their entry count hold
+// a raw bloom.Size byte filter under rawFilterMetaName. Later segments hold
+// a marshaled bloom.Filter under filterMetaName, or bloom.BlockedFilter
+// under blockedFilterMetaName.
+const rawFilterMetaName = "filter.bloom"
+const filterMetaName = "filter.bloom.sized"
+const blockedFilterMetaName = "filter.bloom.blocked"
+
+// prefixMetaName is the meta block holding the name of the PrefixExtractor
+// whose prefixes were added to the filter, if any.
+const prefixMetaName = "filter.prefix"
+
+// maxSeqMetaName is the meta block holding the highest sequence number of
+// any entry.
+const maxSeqMetaName = "stats.maxseq"
+
+// filterKeysMetaName is the meta block holding the number of keys and
+// prefixes added to the filter, which merges size their output's filter
+// from. Segments written before it was recorded have no such block.
+const filterKeysMetaName = "stats.filterkeys"
+
+// replacesMetaName is the meta block holding Options.Replaces, each name
+// prefixed with its length. Segments that replace none have no such block.
+const replacesMetaName = "compaction.replaces"
+
+// rangeDelMetaName is the meta block holding the segment's range deletes,
+// encoded as storage.KindRangeDelete entries.
+const rangeDelMetaName = "rangedel"
+
+type blockHandle struct {
+	Offset int64
+	Length int64
+}
+
+// indexEntry locates a data block, along with its first key.
+type indexEntry struct {
+	Key    string
+	Handle blockHandle
+}
+
+// encodeIndexBlock encodes key/handle pairs, as used by both the index and
+// the metaindex.
+func encodeIndexBlock(entries []indexEntry) []byte {
+	buf := make([]byte, 0)
+	for _, entry := range entries {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(entry.Key)))
+		buf = append(buf, entry.Key...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.Handle.Offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.Handle.Length))
+	}
+	return buf
+}
+
+func decodeIndexBlock(data []byte) ([]indexEntry, error) {
+	entries := make([]indexEntry, 0)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("Not enough data to decode index")
+		}
+		keySize := int(binary.BigEndian.Uint32(data))
+		if len(data) < 4+keySize+16 {
+			return nil, fmt.Errorf("Not enough data to decode index")
+		}
+		key := string(data[4 : 4+keySize])
+		data = data[4+keySize:]
+		entries = append(entries, indexEntry{
+			Key: key,
+			Handle: blockHandle{
+				Offset: int64(binary.BigEndian.Uint64(data)),
+				Length: int64(binary.BigEndian.Uint64(data[8:])),
+			},
+		})
+		data = data[16:]
+	}
+	return entries, nil
+}
+
+// writer writes a segment from entries added in key order.
+type writer struct {
+	f           *os.File
+	filePath    string
+	offset      int64
+	compression Compression
+
+	block         []byte
+	blockFirstKey string
+	index         []indexEntry
+	// lastKey is the key of the last entry added, if started is set.
+	lastKey string
+	started bool
+	maxSeq  uint64
+	// Range deletes are written to their own block by finish.
+	rangeDels []storage.EntryData
+	// Keys are added to the filter as they come, so it is sized up front
+	// from the number of keys expected. filterKeys counts those added.
+	filter     bloom.KeyFilter
+	filterName string
+	filterKeys int
+	prefixes   prefixFilter
+	replaces   []string
+	clock      func() time.Time
+}
+
+// prefixFilter picks the prefixes added to a filter alongside its keys.
+type prefixFilter struct {
+	extractor  PrefixExtractor
+	lastPrefix *string
+}
+
+// add calls fn with key, and with its prefix unless that was just added.
+// Keys sharing a prefix are usually adjacent, so this drops most duplicate
+// prefixes.
+func (p *prefixFilter) add(key string, fn func(string)) {
+	fn(key)
+	if p.extractor == nil {
+		return
+	}
+	prefix, ok := p.extractor.Prefix(key)
+	if ok && (p.lastPrefix == nil || prefix != *p.lastPrefix) {
+		fn(prefix)
+		p.lastPrefix = &prefix
+	}
+}
+
+// newWriter starts a segment whose filter is sized for filterKeys keys and
+// prefixes.
+func newWriter(filePath string, opts *Options, filterKeys int) (*writer, error) {
+	f, err := os.Create(filePath + TempSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create segment file: %w", err)
+	}
+
+	w := &writer{f: f, filePath: filePath}
+	if opts == nil {
+		opts = &Options{}
+	}
+	w.compression = opts.Compression
+	w.replaces = opts.Replaces
+	w.clock = opts.Clock
+	w.prefixes.extractor = opts.PrefixExtractor
+	w.filter, w.filterName = newFilter(opts, filterKeys)
+	header := []byte(segmentCookie)
+	header = binary.BigEndian.AppendUint16(header, segmentFileFormat)
+	header = binary.BigEndian.AppendUint32(header, checksum(header))
+	_, err = w.write(header)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to write segment header: %w", err)
+	}
+	return w, nil
+}
+
+func (w *writer) write(data []byte) (blockHandle, error) {
+	handle := blockHandle{Offset: w.offset, Length: int64(len(data))}
+	n, err := w.f.Write(data)
+	w.offset += int64(n)
+	return handle, err
+}
+
+// writeBlock writes a block, stored with the given compression, followed
+// by its trailer.
+func (w *writer) writeBlock(data []byte, compression Compression) (blockHandle, error) {
+	handle, err := w.write(data)
+	if err != nil {
+		return handle, err
+	}
+	trailer := []byte{byte(compression)}
+	crc := crc32.Update(checksum(data), crcTable, trailer)
+	_, err = w.write(binary.BigEndian.AppendUint32(trailer, crc))
+	return handle, err
+}
+
+// add appends an entry. Entries must be added in key order, and the
+// versions of a key newest first, though range deletes may come at any
+// point.
+func (w *writer) add(entry storage.EntryData) error {
+	if entry.Kind == storage.KindRangeDelete {
+		w.rangeDels = append(w.rangeDels, entry)
+		w.maxSeq = max(w.maxSeq, entry.Seq)
+		return nil
+	}
+
+	newKey := !w.started || entry.Key != w.lastKey
+	// Blocks are only split between keys, so a lookup reads one block.
+	if newKey && len(w.block) >= blockSize {
+		err := w.flushBlock()
+		if err != nil {
+			return err
+		}
+	}
+	if len(w.block) == 0 {
+		w.blockFirstKey = entry.Key
+	}
+	w.block = append(w.block, storage.EncodeEntry(entry)...)
+	w.maxSeq = max(w.maxSeq, entry.Seq)
+	if !newKey {
+		return nil
+	}
+	w.lastKey, w.started = entry.Key, true
+
+	w.prefixes.add(entry.Key, func(key string) {
+		w.filter.Insert(key)
+		w.filterKeys++
+	})
+	return nil
+}
+
+func (w *writer) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	data, compression, err := compressBlock(w.compression, w.block)
+	if err != nil {
+		return fmt.Errorf("Failed to compress segment data: %w", err)
+	}
+	handle, err := w.writeBlock(data, compression)
+	if err != nil {
+		return fmt.Errorf("Failed to write segment data: %w", err)
+	}
+	w.index = append(w.index, indexEntry{Key: w.blockFirstKey, Handle: handle})
+	w.block = w.block[:0]
+	return nil
+}
+
+// newFilter returns an empty filter sized for n keys and prefixes, along
+// with the meta block name it is stored under.
+func newFilter(opts *Options, n int) (bloom.KeyFilter, string) {
+	hash := bloom.DefaultHash
+	if opts.FilterHash != bloom.LegacyMurmur3 {
+		hash = opts.FilterHash
+	}
+	if opts.BlockedFilter {
+		filter := bloom.NewBlocked(n, opts.FilterFalsePositiveRate)
+		filter.Hash = hash
+		return filter, blockedFilterMetaName
+	}
+	filter := bloom.New(n, opts.FilterFalsePositiveRate)
+	filter.Hash = hash
+	return filter, filterMetaName
+}
+
+// abort gives up on the segment, removing its file.
+func (w *writer) abort() {
+	w.f.Close()
+	os.Remove(w.filePath + TempSuffix)
+}
+
+// finish writes the trailing blocks and footer, syncs the segment and moves
+// it to its name.
+func (w *writer) finish() (*Table, error) {
+	table, err := w.writeTrailer()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	err = w.f.Close()
+	if err == nil {
+		err = os.Rename(w.filePath+TempSuffix, w.filePath)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(w.filePath))
+	}
+	if err != nil {
+		os.Remove(w.filePath + TempSuffix)
+		return nil, fmt.Errorf("Failed to install segment file: %w", err)
+	}
+	return table, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeTrailer writes everything after the data blocks, and syncs the file.
+func (w *writer) writeTrailer() (*Table, error) {
+	err := w.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	filterData, err := w.filter.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	filterHandle, err := w.writeBlock(filterData, NoCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write segment filter: %w", err)
+	}
+	indexHandle, err := w.writeBlock(encodeIndexBlock(w.index), NoCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write segment index: %w", err)
+	}
+	metaindex := []indexEntry{{Key: w.filterName, Handle: filterHandle}}
+	prefixExtractor := ""
+	if w.prefixes.extractor != nil {
+		prefixExtractor = w.prefixes.extractor.Name()
+		prefixHandle, err := w.writeBlock([]byte(prefixExtractor), NoCompression)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to write segment prefix extractor: %w", err)
+		}
+		metaindex = append(metaindex, indexEntry{Key: prefixMetaName, Handle: prefixHandle})
+	}
+	if len(w.rangeDels) > 0 {
+		rangeDelData := make([]byte, 0)
+		for _, rangeDel := range w.rangeDels {
+			rangeDelData = append(rangeDelData, storage.EncodeEntry(rangeDel)...)
+		}
+		rangeDelHandle, err := w.writeBlock(rangeDelData, NoCompression)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to write segment range deletes: %w", err)
+		}
+		metaindex = append(metaindex, indexEntry{Key: rangeDelMetaName, Handle: rangeDelHandle})
+	}
+	if len(w.replaces) > 0 {
+		replacesData := make([]byte, 0)
+		for _, name := range w.replaces {
+			replacesData = binary.BigEndian.AppendUint32(replacesData, uint32(len(name)))
+			replacesData = append(replacesData, name...)
+		}
+		replacesHandle, err := w.writeBlock(replacesData, NoCompression)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to write segment replaced names: %w", err)
+		}
+		metaindex = append(metaindex, indexEntry{Key: replacesMetaName, Handle: replacesHandle})
+	}
+	maxSeqHandle, err := w.writeBlock(binary.BigEndian.AppendUint64(nil, w.maxSeq), NoCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write segment stats: %w", err)
+	}
+	metaindex = append(metaindex, indexEntry{Key: maxSeqMetaName, Handle: maxSeqHandle})
+	filterKeysHandle, err := w.writeBlock(binary.BigEndian.AppendUint64(nil, uint64(w.filterKeys)), NoCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write segment stats: %w", err)
+	}
+	metaindex = append(metaindex, indexEntry{Key: filterKeysMetaName, Handle: filterKeysHandle})
+	metaindexHandle, err := w.writeBlock(encodeIndexBlock(metaindex), NoCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write segment metaindex: %w", err)
+	}
+
+	footer := make([]byte, 0, footerLen(segmentFileFormat))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(metaindexHandle.Offset))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(metaindexHandle.Length))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(indexHandle.Offset))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(indexHandle.Length))
+	footer = binary.BigEndian.AppendUint32(footer, checksum(footer))
+	footer = binary.BigEndian.AppendUint64(footer, footerMagic)
+	_, err = w.write(footer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write segment footer: %w", err)
+	}
+
+	// The segment must be durable before the log covering it is dropped.
+	err = w.f.Sync()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sync segment file: %w", err)
+	}
+
+	return &Table{
+		FilePath:   w.filePath,
+		version:    segmentFileFormat,
+		index:      w.index,
+		filter:     w.filter,
+		size:       w.offset,
+		maxSeq:     w.maxSeq,
+		filterKeys: w.filterKeys,
+		rangeDels:  w.rangeDels,
+		replaces:   w.replaces,
+		clock:      w.clock,
+
+		prefixExtractor: prefixExtractor,
+	}, nil
+}
+
+// readBlock reads the block at handle, verifying its checksum and
+// decompressing it if the segment has them.
+func (t *Table) readBlock(f *os.File, handle blockHandle) ([]byte, error) {
+	data := make([]byte, handle.Length+trailerLen(t.version))
+	_, err := f.ReadAt(data, handle.Offset)
+	if err == io.EOF {
+		return nil, t.corruption(handle.Offset, "block extends past end of file")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read segment file: %w", err)
+	}
+	return t.decodeBlock(handle, data)
+}
+
+// decodeBlock verifies and decompresses a block read along with its
+// trailer.
+func (t *Table) decodeBlock(handle blockHandle, data []byte) ([]byte, error) {
+	if !hasChecksums(t.version) {
+		return data, nil
+	}
+	checksummed := handle.Length
+	if hasCompression(t.version) {
+		checksummed++
+	}
+	if checksum(data[:checksummed]) != binary.BigEndian.Uint32(data[checksummed:]) {
+		return nil, t.corruption(handle.Offset, "block checksum mismatch")
+	}
+	if !hasCompression(t.version) {
+		return data[:handle.Length], nil
+	}
+
+	data, err := decompressBlock(Compression(data[handle.Length]), data[:handle.Length])
+	if err != nil {
+		return nil, t.corruption(handle.Offset, err.Error())
+	}
+	return data, nil
+}
+
+// decodeEntry decodes an entry from a data block.
+func (t *Table) decodeEntry(data []byte) (*storage.EntryData, int, error) {
+	switch {
+	case hasEntryKinds(t.version):
+		return storage.DecodeEntry(data)
+	case hasSequenceNumbers(t.version):
+		return storage.DecodeSeqEntry(data)
+	default:
+		return storage.DecodeLogEntry(data)
+	}
+}
+
+func (t *Table) corruption(offset int64, reason string) error {
+	return &CorruptionError{Path: t.FilePath, Offset: offset, Reason: reason}
+}
+
+// loadBlockFormat reads the footer, index and meta blocks of a format 2 or
+// later segment, after its cookie and version.
+func loadBlockFormat(f *os.File, filePath string, version uint16) (*Table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Could not stat segment file: %w", err)
+	}
+	table := &Table{
+		FilePath: filePath,
+		version:  version,
+		size:     info.Size(),
+	}
+
+	headerLen := int64(len(segmentCookie) + 2)
+	if hasChecksums(version) {
+		header := make([]byte, headerLen+checksumLen)
+		_, err = f.ReadAt(header, 0)
+		if err != nil {
+			return nil, table.corruption(0, "truncated header")
+		}
+		if checksum(header[:headerLen]) != binary.BigEndian.Uint32(header[headerLen:]) {
+			return nil, table.corruption(0, "header checksum mismatch")
+		}
+		headerLen += checksumLen
+	}
+
+	footerLen := footerLen(version)
+	if info.Size() < headerLen+footerLen {
+		return nil, table.corruption(0, "file too short for footer")
+	}
+	footerOffset := info.Size() - footerLen
+	footer := make([]byte, footerLen)
+	_, err = f.ReadAt(footer, footerOffset)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read segment file: %w", err)
+	}
+	if binary.BigEndian.Uint64(footer[footerLen-8:]) != footerMagic {
+		return nil, table.corruption(footerOffset, "bad footer magic")
+	}
+	if hasChecksums(version) && checksum(footer[:32]) != binary.BigEndian.Uint32(footer[32:]) {
+		return nil, table.corruption(footerOffset, "footer checksum mismatch")
+	}
+	metaindexHandle := blockHandle{
+		Offset: int64(binary.BigEndian.Uint64(footer)),
+		Length: int64(binary.BigEndian.Uint64(footer[8:])),
+	}
+	indexHandle := blockHandle{
+		Offset: int64(binary.BigEndian.Uint64(footer[16:])),
+		Length: int64(binary.BigEndian.Uint64(footer[24:])),
+	}
+
+	data, err := table.readBlock(f, indexHandle)
+	if err != nil {
+		return nil, err
+	}
+	table.index, err = decodeIndexBlock(data)
+	if err != nil {
+		return nil, table.corruption(indexHandle.Offset, err.Error())
+	}
+
+	data, err = table.readBlock(f, metaindexHandle)
+	if err != nil {
+		return nil, err
+	}
+	metaindex, err := decodeIndexBlock(data)
+	if err != nil {
+		return nil, table.corruption(metaindexHandle.Offset, err.Error())
+	}
+
+	hasFilter := false
+	for _, meta := range metaindex {
+		switch meta.Key {
+		case rawFilterMetaName:
+			hasFilter = true
+			data, err = table.readBlock(f, meta.Handle)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) != bloom.Size {
+				return nil, fmt.Errorf("Non-%d filter size is not supported", bloom.Size)
+			}
+			table.filter = &bloom.Filter{Buf: data}
+		case filterMetaName, blockedFilterMetaName:
+			hasFilter = true
+			data, err = table.readBlock(f, meta.Handle)
+			if err != nil {
+				return nil, err
+			}
+			var filter bloom.KeyFilter
+			if meta.Key == filterMetaName {
+				filter = &bloom.Filter{}
+			} else {
+				filter = &bloom.BlockedFilter{}
+			}
+			err = filter.UnmarshalBinary(data)
+			if err != nil {
+				return nil, table.corruption(meta.Handle.Offset, err.Error())
+			}
+			table.filter = filter
+		case prefixMetaName:
+			data, err = table.readBlock(f, meta.Handle)
+			if err != nil {
+				return nil, err
+			}
+			table.prefixExtractor = string(data)
+		case maxSeqMetaName:
+			data, err = table.readBlock(f, meta.Handle)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) != 8 {
+				return nil, table.corruption(meta.Handle.Offset, "bad max sequence number")
+			}
+			table.maxSeq = binary.BigEndian.Uint64(data)
+		case filterKeysMetaName:
+			data, err = table.readBlock(f, meta.Handle)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) != 8 {
+				return nil, table.corruption(meta.Handle.Offset, "bad filter key count")
+			}
+			table.filterKeys = int(binary.BigEndian.Uint64(data))
+		case replacesMetaName:
+			data, err = table.readBlock(f, meta.Handle)
+			if err != nil {
+				return nil, err
+			}
+			for len(data) > 0 {
+				if len(data) < 4 || len(data)-4 < int(binary.BigEndian.Uint32(data)) {
+					return nil, table.corruption(meta.Handle.Offset, "bad replaced segment name")
+				}
+				size := int(binary.BigEndian.Uint32(data))
+				table.replaces = append(table.replaces, string(data[4:4+size]))
+				data = data[4+size:]
+			}
+		case rangeDelMetaName:
+			data, err = table.readBlock(f, meta.Handle)
+			if err != nil {
+				return nil, err
+			}
+			for len(data) > 0 {
+				entry, read, err := storage.DecodeEntry(data)
+				if err != nil {
+					return nil, table.corruption(meta.Handle.Offset, err.Error())
+				}
+				if entry.Kind != storage.KindRangeDelete {
+					return nil, table.corruption(meta.Handle.Offset, "not a range delete")
+				}
+				table.rangeDels = append(table.rangeDels, *entry)
+				data = data[read:]
+			}
+		}
+	}
+	if !hasFilter {
+		return nil, fmt.Errorf("Segment has no filter block")
+	}
+	return table, nil
+}
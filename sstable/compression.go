@@ -0,0 +1,275 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Compression identifies the codec used for a block. It is stored in the
+// block trailer, so the values must never change.
+type Compression uint8
+
+const (
+	NoCompression     Compression = 0
+	SnappyCompression Compression = 1
+	FlateCompression  Compression = 2
+)
+
+var compressionNames = map[Compression]string{
+	NoCompression:     "none",
+	SnappyCompression: "snappy",
+	FlateCompression:  "flate",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+func ParseCompression(name string) (Compression, error) {
+	for compression, compressionName := range compressionNames {
+		if name == compressionName {
+			return compression, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown compression %s", name)
+}
+
+// Codec compresses and decompresses blocks.
+type Codec interface {
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var codecs = map[Compression]Codec{
+	SnappyCompression: snappyCodec{},
+	FlateCompression:  flateCodec{},
+}
+
+// RegisterCodec adds a codec for compression, which must not already be in
+// use. Segments written with it can only be read where it is registered.
+func RegisterCodec(compression Compression, codec Codec) {
+	if _, ok := codecs[compression]; ok || compression == NoCompression {
+		panic(fmt.Sprintf("Codec already registered for compression %s", compression))
+	}
+	codecs[compression] = codec
+}
+
+// compressBlock returns the block compressed with the given codec, unless
+// that does not save enough space to be worth decompressing.
+func compressBlock(compression Compression, data []byte) ([]byte, Compression, error) {
+	codec, ok := codecs[compression]
+	if !ok {
+		return data, NoCompression, nil
+	}
+	compressed, err := codec.Encode(data)
+	if err != nil {
+		return nil, NoCompression, err
+	}
+	if len(compressed) > len(data)-len(data)/8 {
+		return data, NoCompression, nil
+	}
+	return compressed, compression, nil
+}
+
+func decompressBlock(compression Compression, data []byte) ([]byte, error) {
+	if compression == NoCompression {
+		return data, nil
+	}
+	codec, ok := codecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression %s", compression)
+	}
+	return codec.Decode(data)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// snappyCodec implements the Snappy block format: the uncompressed length as
+// a varint, followed by literal and back-reference (copy) elements. Each
+// element starts with a tag byte whose low two bits give its type.
+type snappyCodec struct{}
+
+const (
+	snappyTagLiteral = 0
+	snappyTagCopy1   = 1
+	snappyTagCopy2   = 2
+	snappyTagCopy4   = 3
+
+	snappyHashBits  = 14
+	snappyMaxOffset = 1<<16 - 1
+)
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyHashBits)
+}
+
+func snappyEmitLiteral(dst []byte, lit []byte) []byte {
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy emits a back-reference of length >= 4 bytes.
+func snappyEmitCopy(dst []byte, offset int, length int) []byte {
+	// Copies with a 2 byte offset hold at most 64 bytes. Emit long copies
+	// in pieces, never leaving less than 4 bytes for the last one.
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+func (snappyCodec) Encode(src []byte) ([]byte, error) {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+
+	var table [1 << snappyHashBits]int
+	literalStart := 0
+	for i := 0; i+4 <= len(src); {
+		word := binary.LittleEndian.Uint32(src[i:])
+		h := snappyHash(word)
+		// Table entries are offset by one, so zero means empty.
+		candidate := table[h] - 1
+		table[h] = i + 1
+
+		if candidate < 0 || i-candidate > snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != word {
+			i++
+			continue
+		}
+
+		if literalStart < i {
+			dst = snappyEmitLiteral(dst, src[literalStart:i])
+		}
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyEmitCopy(dst, i-candidate, length)
+		i += length
+		literalStart = i
+	}
+	if literalStart < len(src) {
+		dst = snappyEmitLiteral(dst, src[literalStart:])
+	}
+	return dst, nil
+}
+
+var errSnappyCorrupt = fmt.Errorf("Corrupt snappy block")
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > uint64(len(src))*255 {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, length)
+	src = src[n:]
+
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, size int
+		switch tag & 3 {
+		case snappyTagLiteral:
+			size = int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				extra := size - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			size++
+			if size > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			size = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap the bytes they produce, so go one at a time.
+		start := len(dst) - offset
+		for i := range size {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,241 @@
+package sstable
+
+import (
+	"bigsby/storage"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const cursorBufferSize = 64 * 1024
+
+// Cursor reads a segment's entries in key order, in either direction. Each
+// version of a key is a separate entry, newest first.
+// Reading forwards, consecutive data blocks are read through one buffer,
+// so long scans make few reads. A Cursor is not safe for concurrent use.
+type Cursor struct {
+	table  *Table
+	f      *os.File
+	reader *bufio.Reader
+	// readerOffset is the file offset of the next byte from reader.
+	readerOffset int64
+
+	// block is the index of the loaded block, entries holds its entries
+	// and pos is the current one.
+	block   int
+	entries []storage.EntryData
+	pos     int
+	// started is set once the cursor has been positioned, and valid while
+	// it is at an entry.
+	started bool
+	valid   bool
+	err     error
+}
+
+// NewCursor returns a cursor that is not yet positioned at an entry. It
+// must be closed when no longer needed.
+func (t *Table) NewCursor() (*Cursor, error) {
+	f, err := os.Open(t.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open segment file: %w", err)
+	}
+	return &Cursor{table: t, f: f, block: -1}, nil
+}
+
+// readBlock reads block i, through the buffered reader when reading
+// forwards.
+func (c *Cursor) readBlock(i int, forward bool) ([]byte, error) {
+	handle := c.table.index[i].Handle
+	if !forward {
+		return c.table.readBlock(c.f, handle)
+	}
+
+	if c.reader == nil || c.readerOffset != handle.Offset {
+		section := io.NewSectionReader(c.f, handle.Offset, c.table.size-handle.Offset)
+		if c.reader == nil {
+			c.reader = bufio.NewReaderSize(section, cursorBufferSize)
+		} else {
+			c.reader.Reset(section)
+		}
+		c.readerOffset = handle.Offset
+	}
+
+	data := make([]byte, handle.Length+trailerLen(c.table.version))
+	n, err := io.ReadFull(c.reader, data)
+	c.readerOffset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, c.table.corruption(handle.Offset, "block extends past end of file")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read segment file: %w", err)
+	}
+	return c.table.decodeBlock(handle, data)
+}
+
+func (c *Cursor) loadBlock(i int, forward bool) bool {
+	data, err := c.readBlock(i, forward)
+	entries := make([]storage.EntryData, 0)
+	for err == nil && len(data) > 0 {
+		entry, read, decodeErr := c.table.decodeEntry(data)
+		if decodeErr != nil {
+			err = c.table.corruption(c.table.index[i].Handle.Offset, decodeErr.Error())
+			break
+		}
+		entries = append(entries, *entry)
+		data = data[read:]
+	}
+	if err != nil {
+		c.err = err
+		c.valid = false
+		return false
+	}
+
+	c.block = i
+	c.entries = entries
+	return true
+}
+
+// nextBlock moves to the first entry of the first non-empty block from i.
+func (c *Cursor) nextBlock(i int) bool {
+	c.started = true
+	c.valid = false
+	for ; i < len(c.table.index); i++ {
+		if !c.loadBlock(i, true) {
+			return false
+		}
+		if len(c.entries) > 0 {
+			c.pos = 0
+			c.valid = true
+			return true
+		}
+	}
+	return false
+}
+
+// prevBlock moves to the last entry of the last non-empty block up to i.
+func (c *Cursor) prevBlock(i int) bool {
+	c.started = true
+	c.valid = false
+	for ; i >= 0; i-- {
+		if !c.loadBlock(i, false) {
+			return false
+		}
+		if len(c.entries) > 0 {
+			c.pos = len(c.entries) - 1
+			c.valid = true
+			return true
+		}
+	}
+	return false
+}
+
+// Seek moves to the first entry with a key at or after key, and reports
+// whether there is one.
+func (c *Cursor) Seek(key string) bool {
+	if c.err != nil {
+		return false
+	}
+	i := max(c.table.findBlock(key), 0)
+	if !c.nextBlock(i) {
+		return false
+	}
+	if c.block != i {
+		return true
+	}
+	c.pos = sort.Search(len(c.entries), func(j int) bool {
+		return c.entries[j].Key >= key
+	})
+	if c.pos == len(c.entries) {
+		// Every later block starts after key.
+		return c.nextBlock(i + 1)
+	}
+	return true
+}
+
+// SeekForPrev moves to the last entry with a key at or before key, and
+// reports whether there is one.
+func (c *Cursor) SeekForPrev(key string) bool {
+	if c.err != nil {
+		return false
+	}
+	i := c.table.findBlock(key)
+	if i < 0 {
+		c.started = true
+		c.valid = false
+		return false
+	}
+	if !c.prevBlock(i) {
+		return false
+	}
+	if c.block != i {
+		return true
+	}
+	c.pos = sort.Search(len(c.entries), func(j int) bool {
+		return c.entries[j].Key > key
+	}) - 1
+	if c.pos < 0 {
+		return c.prevBlock(i - 1)
+	}
+	return true
+}
+
+// Next moves to the next entry, or the first one if the cursor has not
+// been positioned, and reports whether there is one.
+func (c *Cursor) Next() bool {
+	if c.err != nil || (c.started && !c.valid) {
+		return false
+	}
+	if !c.started {
+		return c.nextBlock(0)
+	}
+	c.pos++
+	if c.pos < len(c.entries) {
+		return true
+	}
+	return c.nextBlock(c.block + 1)
+}
+
+// Prev moves to the previous entry, or the last one if the cursor has not
+// been positioned, and reports whether there is one.
+func (c *Cursor) Prev() bool {
+	if c.err != nil || (c.started && !c.valid) {
+		return false
+	}
+	if !c.started {
+		return c.prevBlock(len(c.table.index) - 1)
+	}
+	c.pos--
+	if c.pos >= 0 {
+		return true
+	}
+	return c.prevBlock(c.block - 1)
+}
+
+// Key, Value, Seq and Entry return the current entry, while the last move
+// reported there is one.
+func (c *Cursor) Key() string {
+	return c.entries[c.pos].Key
+}
+
+func (c *Cursor) Value() string {
+	return c.entries[c.pos].Value
+}
+
+func (c *Cursor) Seq() uint64 {
+	return c.entries[c.pos].Seq
+}
+
+func (c *Cursor) Entry() storage.EntryData {
+	return c.entries[c.pos]
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+func (c *Cursor) Close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,116 @@
+package sstable
+
+import (
+	"bigsby/bloom"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format 1 segments are a header (cookie, version, bloom filter length and
+// bloom filter) followed by the entries, with nothing after them. They have
+// no index, so Load rebuilds a sparse one in memory, recording the key and
+// file offset of every indexInterval-th entry.
+
+const indexInterval = 16
+
+// loadFormat1 reads the rest of a format 1 segment, after its cookie and
+// version.
+func loadFormat1(f *os.File, filePath string) (*Table, error) {
+	dataStartIndex := len(segmentCookie) + 2
+
+	filterLenBuf := make([]byte, 4)
+	n, err := f.Read(filterLenBuf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read segment file: %w", err)
+	}
+	if n != 4 {
+		return nil, fmt.Errorf("Failed to read filter length in segment file")
+	}
+	dataStartIndex += n
+	filterLen := binary.BigEndian.Uint32(filterLenBuf)
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Could not stat segment file: %w", err)
+	}
+	if filterLen == 0 || int64(filterLen) > info.Size() {
+		return nil, &CorruptionError{Path: filePath, Offset: int64(dataStartIndex), Reason: "bad filter length"}
+	}
+
+	// Format 1 filters always use the original number of hashes, whatever
+	// their size.
+	filterBuf := make([]byte, filterLen)
+	_, err = io.ReadFull(f, filterBuf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read filter in segment file: %w", err)
+	}
+	dataStartIndex += len(filterBuf)
+
+	index, err := scanIndex(f, int64(dataStartIndex))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load segment index: %w", err)
+	}
+
+	// Each index point starts a run of entries that ends at the next one.
+	for i := range index {
+		end := info.Size()
+		if i+1 < len(index) {
+			end = index[i+1].Handle.Offset
+		}
+		index[i].Handle.Length = end - index[i].Handle.Offset
+	}
+
+	return &Table{
+		FilePath: filePath,
+		version:  1,
+		index:    index,
+		filter: &bloom.Filter{
+			Buf: filterBuf,
+		},
+		size: info.Size(),
+	}, nil
+}
+
+// scanIndex builds the sparse index of a format 1 segment by reading
+// through its entries.
+func scanIndex(f *os.File, dataStartIndex int64) ([]indexEntry, error) {
+	_, err := f.Seek(dataStartIndex, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read segment file: %w", err)
+	}
+	reader := bufio.NewReader(f)
+
+	index := make([]indexEntry, 0)
+	offset := dataStartIndex
+	lengthBuf := make([]byte, 4)
+	for i := 0; ; i++ {
+		// Each entry is key length + key + value length + value.
+		_, err := io.ReadFull(reader, lengthBuf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read segment file: %w", err)
+		}
+		key := make([]byte, binary.BigEndian.Uint32(lengthBuf))
+		_, err = io.ReadFull(reader, key)
+		if err == nil {
+			_, err = io.ReadFull(reader, lengthBuf)
+		}
+		if err == nil {
+			_, err = reader.Discard(int(binary.BigEndian.Uint32(lengthBuf)))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read segment file: %w", err)
+		}
+
+		if i%indexInterval == 0 {
+			index = append(index, indexEntry{Key: string(key), Handle: blockHandle{Offset: offset}})
+		}
+		offset += 8 + int64(len(key)) + int64(binary.BigEndian.Uint32(lengthBuf))
+	}
+	return index, nil
+}
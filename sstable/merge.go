@@ -0,0 +1,115 @@
+package sstable
+
+import (
+	"bigsby/storage"
+	"container/heap"
+	"math"
+)
+
+// cursorHeap orders cursors by their current key, then newest version
+// first. Versions with the same sequence number are ordered by index in
+// cursors, which puts newer data first.
+type cursorHeap struct {
+	cursors []*Cursor
+	order   []int
+}
+
+func (h *cursorHeap) Len() int { return len(h.order) }
+
+func (h *cursorHeap) Less(i, j int) bool {
+	a, b := h.cursors[h.order[i]], h.cursors[h.order[j]]
+	if a.Key() != b.Key() {
+		return a.Key() < b.Key()
+	}
+	if a.Seq() != b.Seq() {
+		return a.Seq() > b.Seq()
+	}
+	return h.order[i] < h.order[j]
+}
+
+func (h *cursorHeap) Swap(i, j int) { h.order[i], h.order[j] = h.order[j], h.order[i] }
+
+func (h *cursorHeap) Push(x any) { h.order = append(h.order, x.(int)) }
+
+func (h *cursorHeap) Pop() any {
+	last := h.order[len(h.order)-1]
+	h.order = h.order[:len(h.order)-1]
+	return last
+}
+
+// advance moves the top cursor on, dropping it once it is exhausted.
+func (h *cursorHeap) advance() error {
+	c := h.cursors[h.order[0]]
+	if c.Next() {
+		heap.Fix(h, 0)
+		return nil
+	}
+	heap.Pop(h)
+	return c.Err()
+}
+
+// hiddenAt returns the sequence number of the oldest range delete that
+// deletes the version of key written at seq, or math.MaxUint64 if none does.
+func hiddenAt(rangeDels []storage.EntryData, key string, seq uint64) uint64 {
+	oldest := uint64(math.MaxUint64)
+	for _, rangeDel := range rangeDels {
+		if rangeDel.Covers(key, seq) {
+			oldest = min(oldest, rangeDel.Seq)
+		}
+	}
+	return oldest
+}
+
+// mergeCursors k-way merges unpositioned cursors, ordered newest first,
+// calling fn with the versions of each key in order. A version is only
+// passed while it is the newest one, or a merge operand above it, or one
+// of snapshots can see it, and rangeDels are treated as newer versions of
+// every key they cover. versions is reused after fn returns.
+func mergeCursors(cursors []*Cursor, snapshots []uint64, rangeDels []storage.EntryData, fn func(versions []storage.EntryData) error) error {
+	h := &cursorHeap{cursors: cursors}
+	for i, c := range cursors {
+		if c.Next() {
+			h.order = append(h.order, i)
+		} else if c.Err() != nil {
+			return c.Err()
+		}
+	}
+	heap.Init(h)
+
+	versions := make([]storage.EntryData, 0)
+	for h.Len() > 0 {
+		key := h.cursors[h.order[0]].Key()
+		versions = versions[:0]
+		// newer is the sequence number of the oldest version written after
+		// the current one that replaces it, which decides which snapshots
+		// can see it. Merge operands build on it instead.
+		newer := uint64(math.MaxUint64)
+		prev := uint64(math.MaxUint64)
+		for h.Len() > 0 && h.cursors[h.order[0]].Key() == key {
+			entry := h.cursors[h.order[0]].Entry()
+			err := h.advance()
+			if err != nil {
+				return err
+			}
+			if entry.Seq == prev {
+				// The same version in an older input, or entries from
+				// segments without sequence numbers.
+				continue
+			}
+			prev = entry.Seq
+			hidden := min(newer, hiddenAt(rangeDels, key, entry.Seq))
+			if hidden == math.MaxUint64 || storage.SnapshotSees(snapshots, entry.Seq, hidden) {
+				versions = append(versions, entry)
+			}
+			if entry.Kind != storage.KindMerge {
+				newer = entry.Seq
+			}
+		}
+
+		err := fn(versions)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
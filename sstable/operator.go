@@ -0,0 +1,68 @@
+package sstable
+
+import (
+	"bigsby/storage"
+	"math"
+)
+
+// MergeOperator folds storage.KindMerge operands into a value, for updates
+// such as incrementing a counter that would otherwise need a read first.
+type MergeOperator interface {
+	// Merge applies operands, oldest first, to the existing value of key,
+	// which is nil if the key has none or was deleted.
+	Merge(key string, existing *string, operands []string) (string, error)
+}
+
+// collapseOperands turns the merge operands among versions of a key, newest
+// first, into puts of their merged values wherever the value beneath them
+// is known: a tombstone or a put without an expiry in versions, a range
+// delete, or nothing at all if last is set. Versions that are then hidden
+// from every snapshot are dropped.
+func collapseOperands(op MergeOperator, versions []storage.EntryData, snapshots []uint64, rangeDels []storage.EntryData, last bool) ([]storage.EntryData, error) {
+	var existing *string
+	known := last
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		if version.Kind != storage.KindMerge {
+			existing, known = nil, true
+			if version.Kind == storage.KindPut {
+				existing = &versions[i].Value
+			}
+			// Operands apply to nothing once the value expires, so
+			// they are left until it has.
+			if version.ExpiresAt != 0 {
+				existing, known = nil, false
+			}
+			continue
+		}
+
+		var below uint64
+		if i+1 < len(versions) {
+			below = versions[i+1].Seq
+		}
+		if storage.NewestRangeDelete(rangeDels, version.Key, version.Seq-1) > below {
+			existing, known = nil, true
+		}
+		if !known {
+			continue
+		}
+		value, err := op.Merge(version.Key, existing, []string{version.Value})
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = storage.EntryData{Key: version.Key, Value: value, Seq: version.Seq}
+		existing = &versions[i].Value
+	}
+
+	kept := versions[:0]
+	newer := uint64(math.MaxUint64)
+	for _, version := range versions {
+		if newer == math.MaxUint64 || storage.SnapshotSees(snapshots, version.Seq, newer) {
+			kept = append(kept, version)
+		}
+		if version.Kind != storage.KindMerge {
+			newer = version.Seq
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,51 @@
+package sstable
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrefixExtractor maps keys to the prefix that is added to segment filters
+// alongside the key, so a segment can be skipped when it has no keys with a
+// given prefix.
+type PrefixExtractor interface {
+	// Name identifies the extractor. It is recorded in each segment, and
+	// prefix checks only use filters built with the same extractor.
+	Name() string
+	// Prefix returns the prefix of key, or false if it has none.
+	Prefix(key string) (string, bool)
+}
+
+// DelimitedPrefix extracts the start of a key up to and including its
+// Parts-th Delimiter, so with Delimiter "/" and Parts 1 the key
+// "tenant/entity/id" has the prefix "tenant/".
+type DelimitedPrefix struct {
+	Delimiter string
+	Parts     int
+}
+
+func (d DelimitedPrefix) Name() string {
+	return fmt.Sprintf("delimited:%d:%s", d.Parts, d.Delimiter)
+}
+
+func (d DelimitedPrefix) Prefix(key string) (string, bool) {
+	end := 0
+	for range max(d.Parts, 1) {
+		i := strings.Index(key[end:], d.Delimiter)
+		if i < 0 {
+			return "", false
+		}
+		end += i + len(d.Delimiter)
+	}
+	return key[:end], true
+}
+
+// MayContainPrefix reports whether the segment may hold keys which
+// extractor maps to prefix. It only returns false if the segment's filter
+// was built with the same extractor.
+func (t *Table) MayContainPrefix(extractor PrefixExtractor, prefix string) bool {
+	if t.prefixExtractor == "" || t.prefixExtractor != extractor.Name() {
+		return true
+	}
+	return t.filter.Search(prefix)
+}
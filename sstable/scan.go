@@ -0,0 +1,69 @@
+package sstable
+
+import (
+	"bigsby/storage"
+	"iter"
+)
+
+// Scan iterates over the entries with keys in [start, end), in order, with
+// every version of a key newest first. An empty end means there is no upper
+// bound.
+// If reading fails the error is yielded, with an empty entry, and the scan
+// stops.
+func (t *Table) Scan(start string, end string) iter.Seq2[storage.EntryData, error] {
+	return func(yield func(storage.EntryData, error) bool) {
+		c, err := t.NewCursor()
+		if err != nil {
+			yield(storage.EntryData{}, err)
+			return
+		}
+		defer c.Close()
+
+		for ok := c.Seek(start); ok; ok = c.Next() {
+			if end != "" && c.Key() >= end {
+				return
+			}
+			if !yield(c.Entry(), nil) {
+				return
+			}
+		}
+		if c.Err() != nil {
+			yield(storage.EntryData{}, c.Err())
+		}
+	}
+}
+
+// ScanReverse iterates over the entries with keys in [start, end) in
+// descending order, as Scan does in ascending order. The versions of a key
+// come oldest first.
+func (t *Table) ScanReverse(start string, end string) iter.Seq2[storage.EntryData, error] {
+	return func(yield func(storage.EntryData, error) bool) {
+		c, err := t.NewCursor()
+		if err != nil {
+			yield(storage.EntryData{}, err)
+			return
+		}
+		defer c.Close()
+
+		var ok bool
+		if end == "" {
+			ok = c.Prev()
+		} else {
+			ok = c.SeekForPrev(end)
+			for ok && c.Key() == end {
+				ok = c.Prev()
+			}
+		}
+		for ; ok; ok = c.Prev() {
+			if c.Key() < start {
+				return
+			}
+			if !yield(c.Entry(), nil) {
+				return
+			}
+		}
+		if c.Err() != nil {
+			yield(storage.EntryData{}, c.Err())
+		}
+	}
+}
@@ -6,19 +6,42 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 type Table struct {
 	FilePath string
-	// index  map[string, int]
-	filter         bloom.Filter
-	dataStartIndex int
+	version  uint16
+	// The first key and location of each data block.
+	index  []indexEntry
+	filter bloom.KeyFilter
+	size   int64
+	refs   atomic.Int32
+	// The name of the PrefixExtractor whose prefixes are in the filter.
+	prefixExtractor string
+	maxSeq          uint64
+	// filterKeys is the number of keys and prefixes in the filter, or zero
+	// if the segment did not record it.
+	filterKeys int
+	rangeDels  []storage.EntryData
+	replaces   []string
+	clock      func() time.Time
 }
 
 const DataFileName = "segment_table"
+
+// TempSuffix is added to a segment's name while it is written, so that it
+// only appears under its own name once complete.
+const TempSuffix = ".tmp"
 const segmentCookie = "BIGSBYSEGMENT"
-const segmentFileFormat = 1
+
+// segmentFileFormat is the version written by Create. Load also reads
+// every older version.
+const segmentFileFormat = 10
 
 // SSTable Requirements:
 // - Immutable
@@ -28,65 +51,85 @@ const segmentFileFormat = 1
 // - Can create new segment from memtable
 // - Can merge two segments together
 
-func Create(filePath string, data []storage.EntryData) (*Table, error) {
-	f, err := os.Create(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("Could not create segment file: %w", err)
-	}
+// Options configure how a segment is written. A nil *Options uses the
+// defaults.
+type Options struct {
+	// Compression is applied to each data block that it shrinks enough.
+	Compression Compression
+	// FilterFalsePositiveRate is the rate the bloom filter is sized for.
+	// It defaults to bloom.DefaultFalsePositiveRate.
+	FilterFalsePositiveRate float64
+	// FilterHash is the hash the bloom filter uses. It defaults to
+	// bloom.DefaultHash.
+	FilterHash bloom.Hash
+	// BlockedFilter selects a bloom.BlockedFilter, which is faster to probe
+	// but slightly larger for the same false positive rate.
+	BlockedFilter bool
+	// PrefixExtractor, if set, adds the prefix of each key to the filter
+	// for MayContainPrefix.
+	PrefixExtractor PrefixExtractor
+	// Snapshots are the sequence numbers of live snapshots, in ascending
+	// order. Merges keep the older versions that they can still see.
+	Snapshots []uint64
+	// Clock gives the time entries expire against, both when merging and
+	// when searching the segment. Without one, entries never expire.
+	Clock func() time.Time
+	// MergeOperator, if set, lets merges fold storage.KindMerge operands
+	// into the values beneath them.
+	MergeOperator MergeOperator
+	// Replaces names the segments a merge's output replaces. It is stored
+	// in the output, so that inputs a crash left behind can be discarded
+	// rather than shadowing the output.
+	Replaces []string
+}
 
-	filter := bloom.Filter{}
-	for _, entry := range data {
-		filter.Insert(entry.Key)
+func Create(filePath string, data []storage.EntryData, opts *Options) (*Table, error) {
+	// Count what the filter will hold, so it can be sized before the
+	// entries are written.
+	filterKeys := 0
+	prefixes := prefixFilter{}
+	if opts != nil {
+		prefixes.extractor = opts.PrefixExtractor
+	}
+	for i, entry := range data {
+		if entry.Kind == storage.KindRangeDelete || (i > 0 && entry.Key == data[i-1].Key) {
+			continue
+		}
+		prefixes.add(entry.Key, func(string) { filterKeys++ })
 	}
 
-	// Write bigsby segment cookie
-	// cookie + version + bloom filter len + bloom filter data
-	headerLen := len(segmentCookie) + 2 + 4 + len(filter.Buf)
-	header := make([]byte, headerLen)
-	idx := 0
-
-	copy(header[idx:], segmentCookie)
-	idx += len(segmentCookie)
-	binary.BigEndian.PutUint16(header[idx:], segmentFileFormat)
-	idx += 2
-	binary.BigEndian.PutUint32(header[idx:], uint32(len(filter.Buf)))
-	idx += 4
-	copy(header[idx:], filter.Buf[:])
-	idx += len(filter.Buf)
-
-	f.Write(header)
+	w, err := newWriter(filePath, opts, filterKeys)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: Write index to disk for loading.
 	for _, entry := range data {
-		_, err := f.Write(storage.EncodeLogEntry(entry))
+		err = w.add(entry)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to write segment data: %w", err)
+			w.abort()
+			return nil, err
 		}
 	}
-
-	return &Table{
-		FilePath:       filePath,
-		filter:         filter,
-		dataStartIndex: headerLen,
-	}, nil
+	return w.finish()
 }
 
-func Load(filePath string) (*Table, error) {
+// Load reads the segment at filePath. Only opts.Clock is used, as the
+// segment's other options were fixed when it was written.
+func Load(filePath string, opts *Options) (*Table, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot open segment file: %w", err)
 	}
+	defer f.Close()
 
-	dataStartIndex := 0
 	cookie := make([]byte, len(segmentCookie))
 	n, err := f.Read(cookie)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read segment file: %w", err)
 	}
 	if n != len(segmentCookie) || !bytes.Equal(cookie, []byte(segmentCookie)) {
-		return nil, fmt.Errorf("Failed to read cookie in segment file")
+		return nil, &CorruptionError{Path: filePath, Reason: "bad segment cookie"}
 	}
-	dataStartIndex += n
 
 	versionBuf := make([]byte, 2)
 	n, err = f.Read(versionBuf)
@@ -96,139 +139,302 @@ func Load(filePath string) (*Table, error) {
 	if n != 2 {
 		return nil, fmt.Errorf("Failed to read version in segment file")
 	}
-	dataStartIndex += n
+
 	version := binary.BigEndian.Uint16(versionBuf)
-	if version != segmentFileFormat {
+	var table *Table
+	switch version {
+	case 1:
+		table, err = loadFormat1(f, filePath)
+	case 2, 3, 4, 5, 6, 7, 8, 9, 10:
+		table, err = loadBlockFormat(f, filePath, version)
+	default:
 		return nil, fmt.Errorf("Could not read segment file with version %d", version)
 	}
-
-	filterLenBuf := make([]byte, 4)
-	n, err = f.Read(filterLenBuf)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read segment file: %w", err)
-	}
-	if n != 4 {
-		return nil, fmt.Errorf("Failed to read filter length in segment file")
+		return nil, err
 	}
-	dataStartIndex += n
-	filterLen := binary.BigEndian.Uint32(filterLenBuf)
-	if filterLen != bloom.Size {
-		return nil, fmt.Errorf("Non-%d filter size is not supported", bloom.Size)
+	if opts != nil {
+		table.clock = opts.Clock
 	}
+	return table, nil
+}
 
-	filterBuf := make([]byte, filterLen)
-	n, err = f.Read(filterBuf)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read segment file: %w", err)
+func Merge(newer *Table, older *Table, newFilePath string, last bool, opts *Options) (*Table, error) {
+	return MergeAll([]*Table{newer, older}, newFilePath, last, opts)
+}
+
+// MergeAll merges tables, ordered newest first, into a new segment, keeping
+// the newest version of each key and any older ones visible to
+// opts.Snapshots. Versions covered by range deletes are dropped unless a
+// snapshot still sees them. If last is set there is no older data the output
+// could shadow, so tombstones are dropped too. Entries that have expired as
+// of opts.Clock are treated as tombstones, and merge operands are folded by
+// opts.MergeOperator where the value beneath them is known. Entries are
+// streamed from the inputs to the output, so only a block from each is held
+// in memory, along with the output's index and filter, which is sized from
+// the key counts the inputs recorded.
+func MergeAll(tables []*Table, newFilePath string, last bool, opts *Options) (*Table, error) {
+	var extractor PrefixExtractor
+	if opts != nil {
+		extractor = opts.PrefixExtractor
 	}
-	if n != len(filterBuf) {
-		return nil, fmt.Errorf("Failed to read filter in segment file")
+	filterKeys := 0
+	for _, table := range tables {
+		n, err := table.filterKeyBound(extractor)
+		if err != nil {
+			return nil, err
+		}
+		filterKeys += n
 	}
-	dataStartIndex += n
-
-	// TODO: Read index from disk.
-	return &Table{
-		FilePath: filePath,
-		filter: bloom.Filter{
-			Buf: [bloom.Size]byte(filterBuf),
-		},
-		dataStartIndex: dataStartIndex,
-	}, nil
-}
 
-func Merge(newer *Table, older *Table, newFilePath string, last bool) (*Table, error) {
-	newerEntriesPtr, err := newer.Read()
-	if err != nil {
-		return nil, err
+	cursors := make([]*Cursor, 0, len(tables))
+	defer func() {
+		for _, c := range cursors {
+			c.Close()
+		}
+	}()
+	for _, table := range tables {
+		c, err := table.NewCursor()
+		if err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, c)
 	}
 
-	olderEntriesPtr, err := older.Read()
+	w, err := newWriter(newFilePath, opts, filterKeys)
 	if err != nil {
 		return nil, err
 	}
-
-	olderEntries, newerEntries := *olderEntriesPtr, *newerEntriesPtr
-	newerSize, olderSize := len(newerEntries), len(olderEntries)
-	newerIndex, olderIndex := 0, 0
-	merged := make([]storage.EntryData, 0, olderSize+newerSize)
-
-	for newerIndex < newerSize || olderIndex < olderSize {
-		if newerIndex >= newerSize {
-			merged = append(merged, olderEntries[olderIndex])
-			olderIndex += 1
-			continue
+	var snapshots []uint64
+	var op MergeOperator
+	var clock func() time.Time
+	if opts != nil {
+		snapshots = opts.Snapshots
+		op = opts.MergeOperator
+		clock = opts.Clock
+	}
+	var now time.Time
+	if clock != nil {
+		now = clock()
+	}
+	rangeDels := make([]storage.EntryData, 0)
+	for _, table := range tables {
+		rangeDels = append(rangeDels, table.rangeDels...)
+	}
+	err = mergeCursors(cursors, snapshots, rangeDels, func(versions []storage.EntryData) error {
+		// Expired entries become tombstones, so older versions stay
+		// hidden.
+		for i, entry := range versions {
+			if entry.Kind == storage.KindPut && clock != nil && entry.Expired(now) {
+				versions[i] = storage.EntryData{Key: entry.Key, Seq: entry.Seq, Kind: storage.KindDelete}
+			}
 		}
-
-		if olderIndex >= olderSize {
-			new := newerEntries[newerIndex]
-			if !last || new.Value != storage.Tombstone {
-				merged = append(merged, new)
+		if op != nil {
+			var err error
+			versions, err = collapseOperands(op, versions, snapshots, rangeDels, last)
+			if err != nil {
+				return err
 			}
-			newerIndex += 1
+		}
+		// A tombstone older than every version kept above it only hides
+		// older data, so it can go too.
+		for last && len(versions) > 0 && versions[len(versions)-1].Kind == storage.KindDelete {
+			versions = versions[:len(versions)-1]
+		}
+		for _, entry := range versions {
+			err := w.add(entry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, rangeDel := range rangeDels {
+		if err != nil {
+			break
+		}
+		// With nothing older left, a range delete only matters to the
+		// versions kept for snapshots from before it.
+		if last && !storage.SnapshotSees(snapshots, 0, rangeDel.Seq) {
 			continue
 		}
+		err = w.add(rangeDel)
+	}
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w.finish()
+}
+
+// filterKeyBound returns an upper bound on the keys and prefixes the
+// table's entries add to a filter that uses extractor.
+func (t *Table) filterKeyBound(extractor PrefixExtractor) (int, error) {
+	if t.filterKeys == 0 {
+		// Segments from before the count was recorded are read through to
+		// count their keys. Each may add a prefix too.
+		keys, err := t.countKeys()
+		if extractor != nil {
+			keys *= 2
+		}
+		return keys, err
+	}
+	if extractor != nil && extractor.Name() != t.prefixExtractor {
+		return t.filterKeys * 2, nil
+	}
+	return t.filterKeys, nil
+}
 
-		new, old := newerEntries[newerIndex], olderEntries[olderIndex]
+// countKeys returns the number of distinct keys in the data blocks.
+func (t *Table) countKeys() (int, error) {
+	c, err := t.NewCursor()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
 
-		if new.Key > old.Key {
-			merged = append(merged, old)
-			olderIndex += 1
-		} else if new.Key == old.Key {
-			if !last || new.Value != storage.Tombstone {
-				merged = append(merged, new)
-			}
-			olderIndex += 1
-			newerIndex += 1
-		} else {
-			if !last || new.Value != storage.Tombstone {
-				merged = append(merged, new)
-			}
-			newerIndex += 1
+	keys := 0
+	lastKey := ""
+	for c.Next() {
+		if keys == 0 || c.Key() != lastKey {
+			keys++
+			lastKey = c.Key()
 		}
 	}
-	return Create(newFilePath, merged)
+	return keys, c.Err()
 }
 
+// findBlock returns the index of the only data block that can hold key, or
+// -1 if key sorts before every entry.
+func (t *Table) findBlock(key string) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].Key > key
+	}) - 1
+}
+
+// Search returns the newest value for key, or nil if the key is absent,
+// deleted or expired by the segment's clock. Merge operands need the older values beneath them, so
+// nil is returned for them too.
 func (t *Table) Search(key string) (*string, error) {
+	entry, err := t.Get(key, math.MaxUint64)
+	if entry == nil || entry.Kind != storage.KindPut || err != nil {
+		return nil, err
+	}
+	if t.clock != nil && entry.Expired(t.clock()) {
+		return nil, nil
+	}
+	return &entry.Value, nil
+}
 
+// Get returns the newest entry for key with a sequence number at or below
+// seq, or nil if there is none. If that is a range delete, a
+// storage.KindDelete entry is returned with its sequence number.
+func (t *Table) Get(key string, seq uint64) (*storage.EntryData, error) {
+	entry, err := t.getEntry(key, seq)
+	if err != nil {
+		return nil, err
+	}
+	rangeSeq := storage.NewestRangeDelete(t.rangeDels, key, seq)
+	if rangeSeq > 0 && (entry == nil || rangeSeq > entry.Seq) {
+		return &storage.EntryData{Key: key, Seq: rangeSeq, Kind: storage.KindDelete}, nil
+	}
+	return entry, nil
+}
+
+// getEntry returns the newest entry in the data blocks for key at or below
+// seq.
+func (t *Table) getEntry(key string, seq uint64) (*storage.EntryData, error) {
 	// If not found in bloom filter, no lookup needed.
 	if !t.filter.Search(key) {
 		return nil, nil
 	}
 
-	// TODO: Start from index location.
-	data, err := os.ReadFile(t.FilePath)
+	i := t.findBlock(key)
+	if i < 0 {
+		return nil, nil
+	}
+
+	f, err := os.Open(t.FilePath)
 	if err != nil {
-		return nil, fmt.Errorf("Could not read segment file: %w", err)
+		return nil, fmt.Errorf("Could not open segment file: %w", err)
 	}
-	ptr := t.dataStartIndex
-	for ptr < len(data) {
-		entry, read, err := storage.DecodeLogEntry(data[ptr:])
+	defer f.Close()
+
+	handle := t.index[i].Handle
+	data, err := t.readBlock(f, handle)
+	if err != nil {
+		return nil, err
+	}
+	for len(data) > 0 {
+		entry, read, err := t.decodeEntry(data)
 		if err != nil {
-			return nil, fmt.Errorf("Could not read segment file: %w", err)
+			return nil, t.corruption(handle.Offset, err.Error())
 		}
-		if entry.Key == key {
-			return &entry.Value, nil
+		if entry.Key == key && entry.Seq <= seq {
+			return entry, nil
 		}
-		ptr += read
+		if entry.Key > key {
+			break
+		}
+		data = data[read:]
 	}
 	return nil, nil
 }
 
 func (t *Table) Read() (*[]storage.EntryData, error) {
-	data, err := os.ReadFile(t.FilePath)
+	c, err := t.NewCursor()
 	if err != nil {
-		return nil, fmt.Errorf("Could not read segment file: %w", err)
+		return nil, err
 	}
-	ptr := t.dataStartIndex
+	defer c.Close()
+
 	entries := make([]storage.EntryData, 0)
-	for ptr < len(data) {
-		entry, read, err := storage.DecodeLogEntry(data[ptr:])
-		if err != nil {
-			return nil, fmt.Errorf("Could not read segment file: %w", err)
-		}
-		ptr += read
-		entries = append(entries, *entry)
+	for c.Next() {
+		entries = append(entries, c.Entry())
+	}
+	if c.Err() != nil {
+		return nil, c.Err()
 	}
 	return &entries, nil
 }
+
+// Remove deletes the segment's file.
+func (t *Table) Remove() error {
+	return os.Remove(t.FilePath)
+}
+
+// Replaces returns the names of the segments the segment was merged to
+// replace, as given in Options.Replaces.
+func (t *Table) Replaces() []string {
+	return t.replaces
+}
+
+// RangeDeletes returns the segment's storage.KindRangeDelete entries.
+func (t *Table) RangeDeletes() []storage.EntryData {
+	return t.rangeDels
+}
+
+// MaxSeq returns the highest sequence number of any entry in the segment.
+func (t *Table) MaxSeq() uint64 {
+	return t.maxSeq
+}
+
+// Size returns the size of the segment file in bytes.
+func (t *Table) Size() int64 {
+	return t.size
+}
+
+// Ref marks the table as in use by a reader, so its file is not removed
+// from under it. Each Ref must be paired with an Unref.
+func (t *Table) Ref() {
+	t.refs.Add(1)
+}
+
+func (t *Table) Unref() {
+	t.refs.Add(-1)
+}
+
+// InUse reports whether any reader holds a reference to the table.
+func (t *Table) InUse() bool {
+	return t.refs.Load() > 0
+}
@@ -0,0 +1,1052 @@
+package sstable
+
+import (
+	"bigsby/bloom"
+	"bigsby/storage"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntries(n int) []storage.EntryData {
+	entries := make([]storage.EntryData, n)
+	for i := range n {
+		entries[i] = storage.EntryData{
+			Key:   fmt.Sprintf("key%04d", i*2),
+			Value: fmt.Sprintf("value%d", i),
+		}
+	}
+	return entries
+}
+
+// writeFormat1 writes entries the way format 1 segments were written.
+func writeFormat1(t *testing.T, filePath string, entries []storage.EntryData) {
+	filter := bloom.Filter{}
+	for _, entry := range entries {
+		filter.Insert(entry.Key)
+	}
+
+	data := []byte(segmentCookie)
+	data = binary.BigEndian.AppendUint16(data, 1)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(filter.Buf)))
+	data = append(data, filter.Buf[:]...)
+	for _, entry := range entries {
+		data = append(data, storage.EncodeLogEntry(entry)...)
+	}
+
+	err := os.WriteFile(filePath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTable(t *testing.T, table *Table, entries []storage.EntryData) {
+	for i, entry := range entries {
+		valPtr, err := table.Search(entry.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valPtr == nil || *valPtr != entry.Value {
+			t.Errorf("Could not find %s in segment", entry.Key)
+		}
+
+		missing := fmt.Sprintf("key%04d", i*2+1)
+		valPtr, err = table.Search(missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valPtr != nil {
+			t.Errorf("Found unexpected value for %s: %s", missing, *valPtr)
+		}
+	}
+
+	read, err := table.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*read) != len(entries) {
+		t.Fatalf("Read %d entries (expected %d)", len(*read), len(entries))
+	}
+	for i, entry := range *read {
+		if entry != entries[i] {
+			t.Errorf("Read unexpected entry %v (expected %v)", entry, entries[i])
+		}
+	}
+}
+
+func TestCreateLoad(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	entries := testEntries(2000)
+
+	table, err := Create(filePath, entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.index) < 2 {
+		t.Errorf("Expected entries to span several blocks, got %d", len(table.index))
+	}
+	checkTable(t, table, entries)
+
+	// The index is read back from the segment file itself.
+	loaded, err := Load(filePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded.index, table.index) {
+		t.Errorf("Loaded index %v (expected %v)", loaded.index, table.index)
+	}
+	checkTable(t, loaded, entries)
+	files, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Found %d files for one segment (expected 1)", len(files))
+	}
+}
+
+func TestLoadFormat1(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	entries := testEntries(100)
+	writeFormat1(t, filePath, entries)
+
+	table, err := Load(filePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.version != 1 {
+		t.Errorf("Loaded segment with version %d (expected 1)", table.version)
+	}
+	// The sparse index is rebuilt in memory, without writing anything.
+	if len(table.index) != (len(entries)+indexInterval-1)/indexInterval {
+		t.Errorf("Rebuilt index with %d points for %d entries", len(table.index), len(entries))
+	}
+	checkTable(t, table, entries)
+	files, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Found %d files after loading a format 1 segment (expected 1)", len(files))
+	}
+}
+
+func TestMigrateTombstones(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "test.segment")
+	entries := testEntries(100)
+	entries[7].Value = storage.Tombstone
+	writeFormat1(t, filePath, entries)
+
+	table, err := Load(filePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := table.Get(entries[7].Key, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Kind != storage.KindDelete || entry.Value != "" {
+		t.Errorf("Got %v for a legacy tombstone (expected a delete)", entry)
+	}
+	valPtr, err := table.Search(entries[7].Key)
+	if err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v searching for a legacy tombstone", valPtr, err)
+	}
+
+	merged, err := MergeAll([]*Table{table}, filepath.Join(dir, "merged.segment"), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := merged.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*read) != len(entries)-1 {
+		t.Errorf("Merged %d entries (expected %d)", len(*read), len(entries)-1)
+	}
+	for _, entry := range *read {
+		if entry.Key == entries[7].Key {
+			t.Errorf("Found %v after dropping tombstones", entry)
+		}
+	}
+}
+
+func flipByte(t *testing.T, filePath string, offset int64) {
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	if err == nil {
+		b[0] ^= 0x10
+		_, err = f.WriteAt(b, offset)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataBlockCorruption(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	entries := testEntries(2000)
+
+	table, err := Create(filePath, entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := table.index[1]
+	flipByte(t, filePath, block.Handle.Offset+5)
+
+	// Blocks other than the corrupt one are still readable.
+	valPtr, err := table.Search(entries[0].Key)
+	if err != nil || valPtr == nil {
+		t.Errorf("Could not search uncorrupted block: %v", err)
+	}
+
+	_, err = table.Search(block.Key)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected corruption error from search, got %v", err)
+	}
+	if corruption.Path != filePath || corruption.Offset != block.Handle.Offset {
+		t.Errorf("Corruption error has wrong location: %v", corruption)
+	}
+
+	_, err = table.Read()
+	if !errors.As(err, &corruption) {
+		t.Errorf("Expected corruption error from read, got %v", err)
+	}
+}
+
+func TestMetaBlockCorruption(t *testing.T) {
+	dir := t.TempDir()
+	entries := testEntries(10)
+
+	// Corrupt the header, the filter block (right after the single data
+	// block) and the footer in turn.
+	offsets := map[string]func(*Table) int64{
+		"header": func(*Table) int64 { return 3 },
+		"filter": func(table *Table) int64 {
+			block := table.index[0].Handle
+			return block.Offset + block.Length + trailerLen(table.version) + 1
+		},
+		"footer": func(table *Table) int64 { return table.size - 20 },
+	}
+	for name, offset := range offsets {
+		filePath := filepath.Join(dir, name+".segment")
+		table, err := Create(filePath, entries, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flipByte(t, filePath, offset(table))
+
+		_, err = Load(filePath, nil)
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) {
+			t.Errorf("Expected corruption error loading segment with bad %s, got %v", name, err)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	entries := testEntries(2000)
+
+	uncompressed, err := Create(filepath.Join(dir, "none.segment"), entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []Compression{SnappyCompression, FlateCompression} {
+		filePath := filepath.Join(dir, compression.String()+".segment")
+		table, err := Create(filePath, entries, &Options{Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Size() >= uncompressed.Size() {
+			t.Errorf("Compression %s did not shrink segment: %d bytes (uncompressed %d)",
+				compression, table.Size(), uncompressed.Size())
+		}
+		checkTable(t, table, entries)
+
+		loaded, err := Load(filePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTable(t, loaded, entries)
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	repeated := make([]byte, 0)
+	for i := range 1000 {
+		repeated = fmt.Appendf(repeated, "key%d-%s", i%7, random[:i%300])
+	}
+
+	inputs := [][]byte{
+		{},
+		[]byte("abc"),
+		make([]byte, 100000),
+		random,
+		repeated,
+	}
+	for i, input := range inputs {
+		encoded, err := snappyCodec{}.Encode(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := snappyCodec{}.Decode(encoded)
+		if err != nil {
+			t.Fatalf("Could not decode input %d: %v", i, err)
+		}
+		if string(decoded) != string(input) {
+			t.Errorf("Input %d changed after round trip", i)
+		}
+	}
+}
+
+func TestFilterSizing(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	entries := testEntries(5000)
+
+	_, err := Create(filePath, entries, &Options{FilterFalsePositiveRate: 0.001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := Load(filePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := table.filter.(*bloom.Filter)
+	if len(filter.Buf) <= bloom.Size || filter.Hashes != 10 {
+		t.Errorf("Filter has %d bytes and %d hashes, not sized for 5000 entries",
+			len(filter.Buf), filter.Hashes)
+	}
+
+	falsePositives := 0
+	for i := range entries {
+		if table.filter.Search(fmt.Sprintf("key%04d", i*2+1)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 20 {
+		t.Errorf("Got %d false positives from 5000 missing keys", falsePositives)
+	}
+}
+
+func TestMergeFilterSizing(t *testing.T) {
+	dir := t.TempDir()
+	entries := testEntries(5000)
+	opts := &Options{FilterFalsePositiveRate: 0.001}
+
+	created, err := Create(filepath.Join(dir, "created.segment"), entries[:3000], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.filterKeys != 3000 {
+		t.Errorf("Created segment counted %d filter keys (expected 3000)", created.filterKeys)
+	}
+	// Format 1 segments have no count, so theirs is read from the data.
+	format1Path := filepath.Join(dir, "format1.segment")
+	writeFormat1(t, format1Path, entries[2000:])
+	format1, err := Load(format1Path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := MergeAll([]*Table{created, format1}, filepath.Join(dir, "merged.segment"), true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err = Load(merged.FilePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.filterKeys != len(entries) {
+		t.Errorf("Merged segment counted %d filter keys (expected %d)", merged.filterKeys, len(entries))
+	}
+	checkTable(t, merged, entries)
+
+	falsePositives := 0
+	for i := range entries {
+		if merged.filter.Search(fmt.Sprintf("key%04d", i*2+1)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 20 {
+		t.Errorf("Got %d false positives from 5000 missing keys", falsePositives)
+	}
+}
+
+func TestBlockedFilter(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	entries := testEntries(2000)
+
+	table, err := Create(filePath, entries, &Options{BlockedFilter: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTable(t, table, entries)
+
+	loaded, err := Load(filePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.filter.(*bloom.BlockedFilter); !ok {
+		t.Errorf("Loaded segment has filter %T (expected blocked filter)", loaded.filter)
+	}
+	checkTable(t, loaded, entries)
+}
+
+func TestDelimitedPrefix(t *testing.T) {
+	var data = []struct {
+		parts  int
+		key    string
+		prefix string
+		ok     bool
+	}{
+		{1, "tenant/entity/id", "tenant/", true},
+		{2, "tenant/entity/id", "tenant/entity/", true},
+		{3, "tenant/entity/id", "", false},
+		{1, "tenant", "", false},
+	}
+
+	for _, entry := range data {
+		prefix, ok := DelimitedPrefix{Delimiter: "/", Parts: entry.parts}.Prefix(entry.key)
+		if prefix != entry.prefix || ok != entry.ok {
+			t.Errorf("Got prefix %q, %v for %s with %d parts (expected %q, %v)",
+				prefix, ok, entry.key, entry.parts, entry.prefix, entry.ok)
+		}
+	}
+}
+
+func TestPrefixFilter(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	extractor := DelimitedPrefix{Delimiter: "/", Parts: 1}
+
+	entries := make([]storage.EntryData, 0)
+	for tenant := 0; tenant < 20; tenant += 2 {
+		for id := range 50 {
+			entries = append(entries, storage.EntryData{
+				Key:   fmt.Sprintf("tenant%02d/entity/%03d", tenant, id),
+				Value: "value",
+			})
+		}
+	}
+	_, err := Create(filePath, entries, &Options{PrefixExtractor: extractor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := Load(filePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for tenant := range 20 {
+		prefix := fmt.Sprintf("tenant%02d/", tenant)
+		if table.MayContainPrefix(extractor, prefix) != (tenant%2 == 0) {
+			t.Errorf("Got wrong result checking segment for prefix %s", prefix)
+		}
+	}
+
+	// Prefixes from another extractor can't rule out anything.
+	other := DelimitedPrefix{Delimiter: "/", Parts: 2}
+	if !table.MayContainPrefix(other, "tenant01/entity/") {
+		t.Error("Expected segment to match prefix from a different extractor")
+	}
+}
+
+func TestScan(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	entries := testEntries(2000)
+	table, err := Create(filePath, entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bounds fall both on and between keys, and across blocks.
+	var data = []struct {
+		start, end string
+		first, n   int
+	}{
+		{"", "", 0, 2000},
+		{"key0100", "key0200", 50, 50},
+		{"key0101", "key0201", 51, 50},
+		{"key1000", "", 500, 1500},
+		{"key9999", "", 0, 0},
+	}
+	for _, entry := range data {
+		// Scanning backwards must find the same entries.
+		i := entry.first + entry.n
+		for scanned, err := range table.ScanReverse(entry.start, entry.end) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			i--
+			if scanned != entries[i] {
+				t.Errorf("Scanned %v in reverse (expected %v)", scanned, entries[i])
+			}
+		}
+		if i != entry.first {
+			t.Errorf("Reverse scan of [%s, %s) stopped at %d (expected %d)", entry.start, entry.end, i, entry.first)
+		}
+
+		i = entry.first
+		for scanned, err := range table.Scan(entry.start, entry.end) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scanned != entries[i] {
+				t.Errorf("Scanned %v (expected %v)", scanned, entries[i])
+			}
+			i++
+		}
+		if i-entry.first != entry.n {
+			t.Errorf("Scanned %d entries in [%s, %s) (expected %d)", i-entry.first, entry.start, entry.end, entry.n)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	dir := t.TempDir()
+	entries := testEntries(2000)
+
+	table, err := Create(filepath.Join(dir, "test.segment"), entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format1Path := filepath.Join(dir, "format1.segment")
+	writeFormat1(t, format1Path, entries)
+	format1, err := Load(format1Path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []*Table{table, format1} {
+		c, err := table.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := 0
+		for c.Next() {
+			if c.Key() != entries[i].Key || c.Value() != entries[i].Value {
+				t.Errorf("Cursor at %s: %s (expected %v)", c.Key(), c.Value(), entries[i])
+			}
+			i++
+		}
+		if i != len(entries) {
+			t.Errorf("Cursor read %d entries (expected %d)", i, len(entries))
+		}
+
+		// Seek backwards and forwards, on and between keys.
+		for _, target := range []int{1500, 3, 0, 3998} {
+			key := fmt.Sprintf("key%04d", target)
+			if !c.Seek(key) {
+				t.Fatalf("Could not seek to %s", key)
+			}
+			expected := entries[(target+1)/2]
+			if c.Key() != expected.Key {
+				t.Errorf("Seek to %s found %s (expected %s)", key, c.Key(), expected.Key)
+			}
+			if c.Next() && c.Key() <= expected.Key {
+				t.Errorf("Next after %s went to %s", expected.Key, c.Key())
+			}
+		}
+		if c.Seek("key9999") {
+			t.Errorf("Seek past the end found %s", c.Key())
+		}
+
+		for _, target := range []int{1500, 3, 3998, 9999} {
+			key := fmt.Sprintf("key%04d", target)
+			if !c.SeekForPrev(key) {
+				t.Fatalf("Could not seek for prev to %s", key)
+			}
+			expected := entries[min(target/2, len(entries)-1)]
+			if c.Key() != expected.Key {
+				t.Errorf("Seek for prev to %s found %s (expected %s)", key, c.Key(), expected.Key)
+			}
+			if c.Prev() && c.Key() >= expected.Key {
+				t.Errorf("Prev before %s went to %s", expected.Key, c.Key())
+			}
+		}
+		if c.SeekForPrev("key") {
+			t.Errorf("Seek for prev before the start found %s", c.Key())
+		}
+		if c.Err() != nil {
+			t.Error(c.Err())
+		}
+		c.Close()
+
+		// A fresh cursor moving backwards starts at the last entry.
+		c, err = table.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		i = len(entries)
+		for c.Prev() {
+			i--
+			if c.Key() != entries[i].Key {
+				t.Errorf("Cursor at %s going backwards (expected %s)", c.Key(), entries[i].Key)
+			}
+		}
+		if i != 0 || c.Err() != nil {
+			t.Errorf("Reverse cursor stopped at entry %d: %v", i, c.Err())
+		}
+		c.Close()
+	}
+}
+
+func TestCursorCorruption(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "test.segment")
+	entries := testEntries(2000)
+
+	table, err := Create(filePath, entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, filePath, table.index[1].Handle.Offset+5)
+
+	c, err := table.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for c.Next() {
+		if c.Key() >= table.index[1].Key {
+			t.Errorf("Read %s from corrupt block", c.Key())
+		}
+	}
+	var corruption *CorruptionError
+	if !errors.As(c.Err(), &corruption) {
+		t.Errorf("Expected corruption error from cursor, got %v", c.Err())
+	}
+}
+
+func TestMergeAll(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each newer table overwrites or removes some of the older keys.
+	tables := make([]*Table, 0)
+	expected := make(map[string]storage.EntryData)
+	for generation := range 3 {
+		entries := make([]storage.EntryData, 0)
+		for i := generation; i < 1000; i += generation + 1 {
+			entry := storage.EntryData{Key: fmt.Sprintf("key%04d", i), Value: fmt.Sprintf("gen%d", generation)}
+			if generation == 2 && i%4 == 0 {
+				entry = storage.EntryData{Key: entry.Key, Kind: storage.KindDelete}
+			}
+			entries = append(entries, entry)
+			expected[entry.Key] = entry
+		}
+		table, err := Create(filepath.Join(dir, fmt.Sprintf("%d.segment", generation)), entries, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append([]*Table{table}, tables...)
+	}
+
+	for _, last := range []bool{false, true} {
+		merged, err := MergeAll(tables, filepath.Join(dir, fmt.Sprintf("merged-%v.segment", last)), last, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := merged.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := 0
+		for i, entry := range *read {
+			if i > 0 && entry.Key <= (*read)[i-1].Key {
+				t.Errorf("Merged entries out of order at %s", entry.Key)
+			}
+			if entry != expected[entry.Key] {
+				t.Errorf("Merged %v (expected %v)", entry, expected[entry.Key])
+			}
+			if last && entry.Kind == storage.KindDelete {
+				t.Errorf("Found tombstone for %s in last merge", entry.Key)
+			}
+			found++
+		}
+
+		live := 0
+		for _, entry := range expected {
+			if !last || entry.Kind != storage.KindDelete {
+				live++
+			}
+		}
+		if found != live {
+			t.Errorf("Merged %d entries (expected %d)", found, live)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every key has versions at seqs 30, 20 and 10, the middle one a
+	// tombstone, with enough keys to fill several blocks.
+	entries := make([]storage.EntryData, 0)
+	for i := range 300 {
+		key := fmt.Sprintf("key%04d", i)
+		entries = append(entries,
+			storage.EntryData{Key: key, Value: fmt.Sprintf("new%d", i), Seq: 30},
+			storage.EntryData{Key: key, Seq: 20, Kind: storage.KindDelete},
+			storage.EntryData{Key: key, Value: fmt.Sprintf("old%d", i), Seq: 10},
+		)
+	}
+	table, err := Create(filepath.Join(dir, "versions.segment"), entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.index) < 2 {
+		t.Fatalf("Expected several data blocks, got %d", len(table.index))
+	}
+	// A key's versions must not be split across blocks, or a lookup could
+	// miss the newest one.
+	for _, block := range table.index {
+		entry, err := table.Get(block.Key, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || entry.Seq != 30 {
+			t.Errorf("Got %v for %s at the start of a block", entry, block.Key)
+		}
+	}
+	read, err := table.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(*read, entries) {
+		t.Error("Read entries do not match those written")
+	}
+
+	table, err = Load(table.FilePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.MaxSeq() != 30 {
+		t.Errorf("Got max seq %d (expected 30)", table.MaxSeq())
+	}
+	for _, test := range []struct {
+		seq   uint64
+		value string
+	}{{5, ""}, {10, "old7"}, {25, "deleted"}, {30, "new7"}, {100, "new7"}} {
+		entry, err := table.Get("key0007", test.seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if entry != nil {
+			got = entry.Value
+			if entry.Kind == storage.KindDelete {
+				got = "deleted"
+			}
+		}
+		if got != test.value {
+			t.Errorf("Got %v at seq %d (expected %q)", entry, test.seq, test.value)
+		}
+	}
+
+	for _, test := range []struct {
+		snapshots []uint64
+		last      bool
+		seqs      []uint64
+	}{
+		{nil, false, []uint64{30}},
+		{[]uint64{15}, false, []uint64{30, 10}},
+		{[]uint64{25}, false, []uint64{30, 20}},
+		{[]uint64{25}, true, []uint64{30}},
+		{[]uint64{5, 15, 25, 35}, false, []uint64{30, 20, 10}},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("merged-%v-%v.segment", test.snapshots, test.last))
+		merged, err := MergeAll([]*Table{table}, path, test.last, &Options{Snapshots: test.snapshots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := merged.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs := make([]uint64, 0)
+		for _, entry := range *read {
+			if entry.Key == "key0007" {
+				seqs = append(seqs, entry.Seq)
+			}
+		}
+		if !slices.Equal(seqs, test.seqs) {
+			t.Errorf("Merge with snapshots %v kept seqs %v (expected %v)", test.snapshots, seqs, test.seqs)
+		}
+	}
+}
+
+func TestRangeDeletes(t *testing.T) {
+	dir := t.TempDir()
+
+	// Even keys from key0000 to key0198 at seq 1, with [key0020, key0040)
+	// deleted at seq 5 and key0030 written again at seq 6.
+	entries := make([]storage.EntryData, 0)
+	for _, entry := range testEntries(100) {
+		entry.Seq = 1
+		if entry.Key == "key0030" {
+			entries = append(entries, storage.EntryData{Key: entry.Key, Value: "again", Seq: 6})
+		}
+		entries = append(entries, entry)
+	}
+	rangeDel := storage.EntryData{Key: "key0020", Value: "key0040", Seq: 5, Kind: storage.KindRangeDelete}
+	table, err := Create(filepath.Join(dir, "test.segment"), append(entries, rangeDel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err = Load(table.FilePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.RangeDeletes()) != 1 || table.RangeDeletes()[0] != rangeDel {
+		t.Errorf("Loaded range deletes %v (expected %v)", table.RangeDeletes(), rangeDel)
+	}
+	if table.MaxSeq() != 6 {
+		t.Errorf("Got max seq %d (expected 6)", table.MaxSeq())
+	}
+
+	for _, test := range []struct {
+		key   string
+		seq   uint64
+		value string
+	}{
+		{"key0018", 10, "value9"},
+		{"key0020", 10, ""},
+		{"key0020", 4, "value10"},
+		{"key0038", 10, ""},
+		{"key0040", 10, "value20"},
+		{"key0030", 10, "again"},
+		{"key0030", 5, ""},
+	} {
+		entry, err := table.Get(test.key, test.seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if entry != nil && entry.Kind == storage.KindPut {
+			got = entry.Value
+		}
+		if got != test.value {
+			t.Errorf("Got %v for %s at seq %d (expected %q)", entry, test.key, test.seq, test.value)
+		}
+	}
+
+	for _, test := range []struct {
+		snapshots []uint64
+		last      bool
+		keys      int
+		rangeDels int
+	}{
+		{nil, false, 91, 1},
+		{nil, true, 91, 0},
+		{[]uint64{3}, true, 100, 1},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("merged-%v-%v.segment", test.snapshots, test.last))
+		merged, err := MergeAll([]*Table{table}, path, test.last, &Options{Snapshots: test.snapshots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := merged.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make(map[string]bool)
+		for _, entry := range *read {
+			keys[entry.Key] = true
+		}
+		if len(keys) != test.keys || len(merged.RangeDeletes()) != test.rangeDels {
+			t.Errorf("Merge with snapshots %v kept %d keys and %d range deletes (expected %d and %d)",
+				test.snapshots, len(keys), len(merged.RangeDeletes()), test.keys, test.rangeDels)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	older, err := Create(filepath.Join(dir, "older.segment"), []storage.EntryData{
+		{Key: "a", Value: "old", Seq: 1},
+		{Key: "b", Value: "old", Seq: 2},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newerEntries := []storage.EntryData{
+		{Key: "a", Value: "expired", Seq: 3, ExpiresAt: now.Add(-time.Second).UnixNano()},
+		{Key: "b", Value: "live", Seq: 4, ExpiresAt: now.Add(time.Second).UnixNano()},
+	}
+	newer, err := Create(filepath.Join(dir, "newer.segment"), newerEntries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a clock, nothing expires.
+	if valPtr, err := newer.Search("a"); err != nil || valPtr == nil || *valPtr != "expired" {
+		t.Errorf("Got %v, %v for key without a clock", valPtr, err)
+	}
+	clock := func() time.Time { return now }
+	newer, err = Load(newer.FilePath, &Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := newer.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(*read, newerEntries) {
+		t.Errorf("Read %v (expected %v)", *read, newerEntries)
+	}
+	if valPtr, err := newer.Search("a"); err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v for expired key", valPtr, err)
+	}
+	if valPtr, err := newer.Search("b"); err != nil || valPtr == nil || *valPtr != "live" {
+		t.Errorf("Got %v, %v for key live as of the clock", valPtr, err)
+	}
+
+	for _, last := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("merged-%v.segment", last))
+		merged, err := MergeAll([]*Table{newer, older}, path, last, &Options{Clock: clock})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := merged.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The expired entry becomes a tombstone hiding the older value, and
+		// goes entirely from the last level.
+		expected := []storage.EntryData{newerEntries[1]}
+		if !last {
+			expected = append([]storage.EntryData{{Key: "a", Seq: 3, Kind: storage.KindDelete}}, expected...)
+		}
+		if !slices.Equal(*read, expected) {
+			t.Errorf("Merged %v with last %v (expected %v)", *read, last, expected)
+		}
+	}
+}
+
+type appendOperator struct{}
+
+func (appendOperator) Merge(key string, existing *string, operands []string) (string, error) {
+	value := ""
+	if existing != nil {
+		value = *existing
+	}
+	return value + strings.Join(operands, ""), nil
+}
+
+func TestMergeOperands(t *testing.T) {
+	dir := t.TempDir()
+	older, err := Create(filepath.Join(dir, "older.segment"), []storage.EntryData{
+		{Key: "a", Value: "1", Seq: 1},
+		{Key: "c", Value: "old", Seq: 2},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := Create(filepath.Join(dir, "newer.segment"), []storage.EntryData{
+		{Key: "a", Value: "3", Seq: 5, Kind: storage.KindMerge},
+		{Key: "a", Value: "2", Seq: 3, Kind: storage.KindMerge},
+		{Key: "b", Value: "x", Seq: 4, Kind: storage.KindMerge},
+		{Key: "c", Value: "new", Seq: 7, Kind: storage.KindMerge},
+		{Key: "c", Seq: 6, Kind: storage.KindDelete},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if valPtr, err := newer.Search("b"); err != nil || valPtr != nil {
+		t.Errorf("Got %v, %v for key with only a merge operand", valPtr, err)
+	}
+
+	tests := []struct {
+		name     string
+		last     bool
+		opts     *Options
+		expected []storage.EntryData
+	}{
+		{"no operator", false, nil, []storage.EntryData{
+			{Key: "a", Value: "3", Seq: 5, Kind: storage.KindMerge},
+			{Key: "a", Value: "2", Seq: 3, Kind: storage.KindMerge},
+			{Key: "a", Value: "1", Seq: 1},
+			{Key: "b", Value: "x", Seq: 4, Kind: storage.KindMerge},
+			{Key: "c", Value: "new", Seq: 7, Kind: storage.KindMerge},
+			{Key: "c", Seq: 6, Kind: storage.KindDelete},
+		}},
+		// Operands with nothing beneath them are kept unless there is
+		// no older data.
+		{"not last", false, &Options{MergeOperator: appendOperator{}}, []storage.EntryData{
+			{Key: "a", Value: "123", Seq: 5},
+			{Key: "b", Value: "x", Seq: 4, Kind: storage.KindMerge},
+			{Key: "c", Value: "new", Seq: 7},
+		}},
+		{"last", true, &Options{MergeOperator: appendOperator{}}, []storage.EntryData{
+			{Key: "a", Value: "123", Seq: 5},
+			{Key: "b", Value: "x", Seq: 4},
+			{Key: "c", Value: "new", Seq: 7},
+		}},
+		{"snapshot", true, &Options{MergeOperator: appendOperator{}, Snapshots: []uint64{3}}, []storage.EntryData{
+			{Key: "a", Value: "123", Seq: 5},
+			{Key: "a", Value: "12", Seq: 3},
+			{Key: "b", Value: "x", Seq: 4},
+			{Key: "c", Value: "new", Seq: 7},
+			{Key: "c", Value: "old", Seq: 2},
+		}},
+	}
+	for i, test := range tests {
+		merged, err := MergeAll([]*Table{newer, older}, filepath.Join(dir, fmt.Sprintf("merged%d.segment", i)), test.last, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := merged.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(*read, test.expected) {
+			t.Errorf("Merged %v with %s (expected %v)", *read, test.name, test.expected)
+		}
+	}
+}
+
+func TestReplaces(t *testing.T) {
+	dir := t.TempDir()
+	older, err := Create(filepath.Join(dir, "older.segment"), testEntries(10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if older.Replaces() != nil {
+		t.Errorf("Flushed segment replaces %v (expected none)", older.Replaces())
+	}
+
+	replaces := []string{"0/older.segment", "0/an older input.segment"}
+	merged, err := MergeAll([]*Table{older}, filepath.Join(dir, "merged.segment"), true, &Options{Replaces: replaces})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err = Load(merged.FilePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.version != segmentFileFormat || !slices.Equal(merged.Replaces(), replaces) {
+		t.Errorf("Loaded version %d segment replacing %v (expected %v)", merged.version, merged.Replaces(), replaces)
+	}
+}
@@ -3,16 +3,63 @@ package storage
 import (
 	"encoding/binary"
 	"fmt"
+	"slices"
+	"time"
+)
+
+// Kind says what an entry does to its key. It is stored with the entry, so
+// the values must never change.
+type Kind uint8
+
+const (
+	KindPut    Kind = 0
+	KindDelete Kind = 1
+	// KindRangeDelete entries delete every key in [Key, Value) written
+	// before them. An empty Value means the range has no upper bound.
+	KindRangeDelete Kind = 2
+	// KindMerge entries hold an operand that a merge operator applies to
+	// the key's older value, rather than a value of their own.
+	KindMerge Kind = 3
+
+	// lastKind is the highest kind this version can decode.
+	lastKind = KindMerge
+
+	// expiryFlag is set in the encoded kind byte of entries with an
+	// expiry time, which follows the kind byte.
+	expiryFlag = 0x80
 )
 
 type EntryData struct {
 	Key   string
 	Value string
+	// Seq orders writes: every write gets a higher sequence number than
+	// the ones before it. Entries written before sequence numbers existed
+	// have Seq 0.
+	Seq  uint64
+	Kind Kind
+	// ExpiresAt is the time, in Unix nanoseconds, after which a put is
+	// treated as deleted. Zero means it never expires.
+	ExpiresAt int64
 }
 
-// TODO: Out-of-band value for this to avoid mixing up values.
+// Expired reports whether the entry has expired as of now.
+func (e EntryData) Expired(now time.Time) bool {
+	return e.ExpiresAt != 0 && now.UnixNano() >= e.ExpiresAt
+}
+
+// Tombstone is the value deletes were stored as before entries had a Kind.
+// The decoders for those encodings turn it into a KindDelete entry.
 const Tombstone = "<BIGSBY_TOMBSTONE>"
 
+// migrateTombstone converts a delete decoded from an encoding without kinds.
+func migrateTombstone(entry *EntryData) *EntryData {
+	if entry.Value == Tombstone {
+		entry.Value = ""
+		entry.Kind = KindDelete
+	}
+	return entry
+}
+
 func EncodeLogEntry(entry EntryData) []byte {
 	keySize, valSize := len(entry.Key), len(entry.Value)
 	logSize := keySize + valSize + 8 // key + val + 2 * uint32_len
@@ -44,8 +91,117 @@ func DecodeLogEntry(data []byte) (*EntryData, int, error) {
 		return nil, 0, fmt.Errorf("Not enough data to decode")
 	}
 	value := string(data[8+keySize : 8+keySize+valueSize])
-	return &EntryData{
+	return migrateTombstone(&EntryData{
 		Key:   key,
 		Value: value,
-	}, bytesToRead, nil
+	}), bytesToRead, nil
+}
+
+// EncodeEntry encodes every field of an entry: the key length, key,
+// sequence number, kind, expiry time if there is one, value length and
+// value.
+func EncodeEntry(entry EntryData) []byte {
+	keySize, valSize := len(entry.Key), len(entry.Value)
+	buf := make([]byte, 0, keySize+valSize+25)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(keySize))
+	buf = append(buf, entry.Key...)
+	buf = binary.BigEndian.AppendUint64(buf, entry.Seq)
+	if entry.ExpiresAt != 0 {
+		buf = append(buf, byte(entry.Kind)|expiryFlag)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.ExpiresAt))
+	} else {
+		buf = append(buf, byte(entry.Kind))
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(valSize))
+	return append(buf, entry.Value...)
+}
+
+func DecodeEntry(data []byte) (*EntryData, int, error) {
+	return decodeEntry(data, true)
+}
+
+// DecodeSeqEntry decodes an entry encoded with its sequence number but no
+// kind, as written before entries had one.
+func DecodeSeqEntry(data []byte) (*EntryData, int, error) {
+	entry, read, err := decodeEntry(data, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	return migrateTombstone(entry), read, nil
+}
+
+func decodeEntry(data []byte, hasKind bool) (*EntryData, int, error) {
+	if len(data) < 4 {
+		return nil, 0, fmt.Errorf("Not enough data to decode")
+	}
+	keySize := int(binary.BigEndian.Uint32(data))
+	ptr := 4
+	fixedSize := 12
+	if hasKind {
+		fixedSize++
+	}
+	if len(data) < ptr+keySize+fixedSize {
+		return nil, 0, fmt.Errorf("Not enough data to decode")
+	}
+	key := string(data[ptr : ptr+keySize])
+	ptr += keySize
+	seq := binary.BigEndian.Uint64(data[ptr:])
+	ptr += 8
+	kind := KindPut
+	var expiresAt int64
+	if hasKind {
+		kind = Kind(data[ptr] &^ expiryFlag)
+		if kind > lastKind {
+			return nil, 0, fmt.Errorf("Unknown entry kind %d", kind)
+		}
+		hasExpiry := data[ptr]&expiryFlag != 0
+		ptr++
+		if hasExpiry {
+			if len(data) < ptr+12 {
+				return nil, 0, fmt.Errorf("Not enough data to decode")
+			}
+			expiresAt = int64(binary.BigEndian.Uint64(data[ptr:]))
+			ptr += 8
+		}
+	}
+	valueSize := int(binary.BigEndian.Uint32(data[ptr:]))
+	ptr += 4
+	if len(data) < ptr+valueSize {
+		return nil, 0, fmt.Errorf("Not enough data to decode")
+	}
+	value := string(data[ptr : ptr+valueSize])
+	return &EntryData{
+		Key:       key,
+		Value:     value,
+		Seq:       seq,
+		Kind:      kind,
+		ExpiresAt: expiresAt,
+	}, ptr + valueSize, nil
+}
+
+// Covers reports whether e is a range delete that deletes the version of key
+// written at seq.
+func (e EntryData) Covers(key string, seq uint64) bool {
+	return e.Kind == KindRangeDelete && seq < e.Seq && key >= e.Key && (e.Value == "" || key < e.Value)
+}
+
+// NewestRangeDelete returns the sequence number of the newest range delete
+// at or below seq that covers key, or 0 if there is none.
+func NewestRangeDelete(rangeDels []EntryData, key string, seq uint64) uint64 {
+	var newest uint64
+	for _, rangeDel := range rangeDels {
+		if rangeDel.Seq <= seq && rangeDel.Seq > newest && rangeDel.Covers(key, 0) {
+			newest = rangeDel.Seq
+		}
+	}
+	return newest
+}
+
+// SnapshotSees reports whether a version of a key written at seq, and
+// replaced by a version written at newerSeq, is still visible to one of
+// the snapshots, given as sorted sequence numbers. A snapshot sees the
+// newest version at or below its sequence number.
+func SnapshotSees(snapshots []uint64, seq uint64, newerSeq uint64) bool {
+	i, _ := slices.BinarySearch(snapshots, seq)
+	return i < len(snapshots) && snapshots[i] < newerSeq
 }
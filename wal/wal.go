@@ -0,0 +1,572 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncMode controls when appended records are fsynced to disk.
+type SyncMode int
+
+const (
+	// SyncEveryWrite fsyncs before every Append returns.
+	SyncEveryWrite SyncMode = iota
+	// SyncGroupCommit makes Append wait for an fsync, but shares a single
+	// fsync between all writers that are waiting at the same time.
+	SyncGroupCommit
+	// SyncInterval fsyncs in the background on a fixed interval. Append does
+	// not wait, so a crash can lose up to one interval of writes.
+	SyncInterval
+)
+
+var syncModeNames = map[SyncMode]string{
+	SyncEveryWrite:  "always",
+	SyncGroupCommit: "group",
+	SyncInterval:    "interval",
+}
+
+func (m SyncMode) String() string {
+	if name, ok := syncModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+func ParseSyncMode(name string) (SyncMode, error) {
+	for mode, modeName := range syncModeNames {
+		if name == modeName {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown sync mode %s", name)
+}
+
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// Log is an append-only write-ahead log. It is split into numbered files
+// (generations) so that records which have been persisted elsewhere can be
+// dropped by removing whole files. A Log is safe for concurrent use.
+type Log struct {
+	dir  string
+	mode SyncMode
+
+	mu   sync.Mutex
+	file *os.File
+	gen  uint64
+	// size is the length of the current file up to its last complete
+	// record. If a failed write cannot be cut back to it, err fails every
+	// Write until the file is rotated.
+	size int64
+	err  error
+	// next is the file Rotate switches to, created ahead of time by
+	// Prepare so that rotating does no I/O. retired holds the files
+	// rotated out since the last sync, which still need syncing, of which
+	// the first retiredSynced are synced but may still be in use by an
+	// fsync in flight.
+	next          *os.File
+	preparing     bool
+	prepared      *sync.Cond
+	retired       []*os.File
+	retiredSynced int
+
+	// Records are counted across all generations; synced trails written
+	// until an fsync covers them. inflight counts the fsyncs running
+	// without mu, and syncing is set while one is a group commit leader.
+	written  uint64
+	synced   uint64
+	inflight int
+	syncing  bool
+	syncDone *sync.Cond
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+const walCookie = "BIGSBYWAL"
+const walFileFormat = 1
+const fileSuffix = ".wal"
+
+// Each record is framed as crc32c(payload) + len(payload) + payload.
+const frameHeaderLen = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func fileName(gen uint64) string {
+	return fmt.Sprintf("%016d%s", gen, fileSuffix)
+}
+
+func listGenerations(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read log directory: %w", err)
+	}
+
+	gens := make([]uint64, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		gen, err := strconv.ParseUint(strings.TrimSuffix(name, fileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, gen)
+	}
+	slices.Sort(gens)
+	return gens, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Open starts a new log file in dir, numbered after any existing files.
+// Existing files are left untouched so they can still be replayed. The
+// interval is only used by SyncInterval, and defaults to DefaultSyncInterval.
+func Open(dir string, mode SyncMode, interval time.Duration) (*Log, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to make log dir: %w", err)
+	}
+
+	gens, err := listGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var gen uint64 = 1
+	if len(gens) > 0 {
+		gen = gens[len(gens)-1] + 1
+	}
+
+	f, err := createFile(dir, gen)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, mode: mode}
+	l.syncDone = sync.NewCond(&l.mu)
+	l.prepared = sync.NewCond(&l.mu)
+	l.setFile(f, gen)
+	err = l.Prepare()
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+
+	if mode == SyncInterval {
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		l.stop = make(chan struct{})
+		l.stopped.Add(1)
+		go l.syncLoop(interval)
+	}
+	return l, nil
+}
+
+func (l *Log) syncLoop(interval time.Duration) {
+	defer l.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			// A failed background sync is retried on the next tick, and
+			// surfaces to callers through Sync, Rotate or Close.
+			l.Sync()
+		}
+	}
+}
+
+const headerLen = len(walCookie) + 2
+
+// createFile creates log file gen in dir and syncs its header.
+func createFile(dir string, gen uint64) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, fileName(gen)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create log file: %w", err)
+	}
+
+	header := make([]byte, headerLen)
+	copy(header, walCookie)
+	binary.BigEndian.PutUint16(header[len(walCookie):], walFileFormat)
+	_, err = f.Write(header)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not write log header: %w", err)
+	}
+	return f, nil
+}
+
+// setFile makes f, a new file from createFile, the current log file. Must be
+// called with mu held.
+func (l *Log) setFile(f *os.File, gen uint64) {
+	l.file, l.gen = f, gen
+	l.size, l.err = int64(headerLen), nil
+}
+
+// Append writes a record to the current log file. Whether it is on disk
+// when Append returns depends on the log's SyncMode.
+func (l *Log) Append(record []byte) error {
+	n, err := l.Write(record)
+	if err != nil {
+		return err
+	}
+	return l.WaitSync(n)
+}
+
+// Write adds a record to the current log file without waiting for it to be
+// synced, and returns its position for WaitSync. Callers that need records
+// ordered with other state can Write under their own lock and WaitSync after
+// releasing it, so concurrent writers can share an fsync.
+func (l *Log) Write(record []byte) (uint64, error) {
+	buf := make([]byte, frameHeaderLen+len(record))
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(record, crcTable))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(record)))
+	copy(buf[frameHeaderLen:], record)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return 0, l.err
+	}
+	_, err := l.file.Write(buf)
+	if err != nil {
+		l.truncate()
+		return 0, fmt.Errorf("Failed to write log record: %w", err)
+	}
+	l.size += int64(len(buf))
+	l.written++
+	return l.written, nil
+}
+
+// truncate cuts off whatever part of a record a failed write left behind.
+// Replay stops at the first bad frame, so records appended after it would
+// be lost. Must be called with mu held.
+func (l *Log) truncate() {
+	err := l.file.Truncate(l.size)
+	if err == nil {
+		_, err = l.file.Seek(l.size, io.SeekStart)
+	}
+	if err != nil {
+		l.err = fmt.Errorf("Log file must be rotated after a failed write: %w", err)
+	}
+}
+
+// WaitSync waits until the record at position n is on disk, as the log's
+// SyncMode requires.
+func (l *Log) WaitSync(n uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch l.mode {
+	case SyncEveryWrite:
+		// Each writer runs its own fsync, alongside any others in flight.
+		return l.syncFiles()
+	case SyncGroupCommit:
+		return l.waitSynced(n)
+	}
+	return nil
+}
+
+// waitSynced blocks until record n is on disk. The first waiter to find no
+// fsync in flight becomes the leader and syncs everything written so far on
+// behalf of the others. Must be called with mu held.
+func (l *Log) waitSynced(n uint64) error {
+	for l.synced < n {
+		if l.syncing {
+			l.syncDone.Wait()
+			continue
+		}
+
+		l.syncing = true
+		err := l.syncFiles()
+		l.syncing = false
+		l.syncDone.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFiles fsyncs the rotated out files and the current file without
+// holding mu, covering every record written before it started. Must be
+// called with mu held.
+func (l *Log) syncFiles() error {
+	target, retired, f := l.written, l.retired, l.file
+	l.inflight++
+	l.mu.Unlock()
+	var err error
+	for _, r := range retired {
+		if err == nil {
+			err = r.Sync()
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	l.mu.Lock()
+	l.inflight--
+	l.syncDone.Broadcast()
+
+	if err != nil {
+		return fmt.Errorf("Failed to sync log: %w", err)
+	}
+	l.synced = max(l.synced, target)
+	// Files rotated out while the sync ran are left for a later one, and
+	// synced files stay open until no other sync could be using them.
+	l.retiredSynced = max(l.retiredSynced, len(retired))
+	if l.inflight > 0 {
+		return nil
+	}
+	synced := l.retired[:l.retiredSynced]
+	l.retired, l.retiredSynced = l.retired[l.retiredSynced:], 0
+	return closeFiles(synced)
+}
+
+func closeFiles(files []*os.File) error {
+	var err error
+	for _, f := range files {
+		closeErr := f.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Failed to close log file: %w", closeErr)
+		}
+	}
+	return err
+}
+
+// syncAll blocks until every record written so far is on disk and no fsync
+// is in flight, so the current file can be closed. Must be called with mu
+// held.
+func (l *Log) syncAll() error {
+	for l.inflight > 0 || l.synced < l.written {
+		if l.inflight > 0 {
+			l.syncDone.Wait()
+			continue
+		}
+		err := l.waitSynced(l.written)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync flushes every record appended so far to disk.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncAll()
+}
+
+// Prepare creates the file the next Rotate switches to, if it does not
+// exist yet. It does its I/O without holding the log's lock, so callers can
+// rotate under a lock of their own without waiting on the disk there.
+func (l *Log) Prepare() error {
+	l.mu.Lock()
+	if l.next != nil || l.preparing {
+		l.mu.Unlock()
+		return nil
+	}
+	l.preparing = true
+	gen := l.gen + 1
+	l.mu.Unlock()
+
+	f, err := createFile(l.dir, gen)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.preparing = false
+	l.prepared.Broadcast()
+	if err != nil {
+		return err
+	}
+	l.next = f
+	return nil
+}
+
+// Rotate starts a new log file, which also clears a failed write that could
+// not be truncated. The old file is synced and closed by the next sync. It
+// returns the generation of the old file, which can later be passed to
+// RemoveThrough. Rotate only does I/O if the next file was not prepared.
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A file being prepared would clash with one created here.
+	for l.next == nil && l.preparing {
+		l.prepared.Wait()
+	}
+	if l.next == nil {
+		next, err := createFile(l.dir, l.gen+1)
+		if err != nil {
+			return 0, err
+		}
+		l.next = next
+	}
+	return l.switchNext(), nil
+}
+
+// RotatePrepared rotates as Rotate does, but only to a file created by
+// Prepare, so it never does I/O. It returns false without rotating if no
+// file is prepared.
+func (l *Log) RotatePrepared() (uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.next == nil {
+		return 0, false
+	}
+	return l.switchNext(), true
+}
+
+// switchNext makes the prepared file the current one, and returns the old
+// file's generation. Must be called with mu held.
+func (l *Log) switchNext() uint64 {
+	old := l.gen
+	l.retired = append(l.retired, l.file)
+	l.setFile(l.next, old+1)
+	l.next = nil
+	return old
+}
+
+// RemoveThrough deletes all log files up to and including generation gen.
+func (l *Log) RemoveThrough(gen uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	gens, err := listGenerations(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, g := range gens {
+		if g > gen || g == l.gen {
+			break
+		}
+		err = os.Remove(filepath.Join(l.dir, fileName(g)))
+		if err != nil {
+			return fmt.Errorf("Failed to remove log file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close syncs any outstanding records and closes the log.
+func (l *Log) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		l.stopped.Wait()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.syncAll()
+	// Rotated files with nothing left to sync may still be open.
+	files := append(l.retired, l.file)
+	if l.next != nil {
+		files = append(files, l.next)
+	}
+	closeErr := closeFiles(files)
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Replay calls fn with every record in dir, oldest first. A file is read up
+// to its first incomplete or mismatched record, which is what a crash in the
+// middle of Append leaves behind.
+func Replay(dir string, fn func(record []byte) error) error {
+	gens, err := listGenerations(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, gen := range gens {
+		data, err := os.ReadFile(filepath.Join(dir, fileName(gen)))
+		if err != nil {
+			return fmt.Errorf("Could not read log file: %w", err)
+		}
+
+		if len(data) < headerLen {
+			// Crashed before the header was written.
+			continue
+		}
+		if !bytes.Equal(data[:len(walCookie)], []byte(walCookie)) {
+			return fmt.Errorf("Failed to read cookie in log file %s", fileName(gen))
+		}
+		version := binary.BigEndian.Uint16(data[len(walCookie):])
+		if version != walFileFormat {
+			return fmt.Errorf("Could not read log file with version %d", version)
+		}
+
+		err = replayRecords(data[headerLen:], fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecord returns the next framed record in data, or false if the frame is
+// incomplete or fails its checksum.
+func readRecord(data []byte) ([]byte, int, bool) {
+	if len(data) < frameHeaderLen {
+		return nil, 0, false
+	}
+	checksum := binary.BigEndian.Uint32(data)
+	size := int(binary.BigEndian.Uint32(data[4:]))
+	if len(data)-frameHeaderLen < size {
+		return nil, 0, false
+	}
+	record := data[frameHeaderLen : frameHeaderLen+size]
+	if crc32.Checksum(record, crcTable) != checksum {
+		return nil, 0, false
+	}
+	return record, frameHeaderLen + size, true
+}
+
+func replayRecords(data []byte, fn func(record []byte) error) error {
+	for len(data) > 0 {
+		record, read, ok := readRecord(data)
+		if !ok {
+			return nil
+		}
+		err := fn(record)
+		if err != nil {
+			return err
+		}
+		data = data[read:]
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func replayAll(t *testing.T, dir string) []string {
+	records := make([]string, 0)
+	err := Replay(dir, func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay log: %v", err)
+	}
+	return records
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncEveryWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"hello", "world", ""}
+	for _, record := range expected {
+		err = log.Append([]byte(record))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Close()
+
+	records := replayAll(t, dir)
+	if len(records) != len(expected) {
+		t.Fatalf("Got %d records (expected %d)", len(records), len(expected))
+	}
+	for i, record := range records {
+		if record != expected[i] {
+			t.Errorf("Got unexpected record: %s (expected %s)", record, expected[i])
+		}
+	}
+}
+
+func TestReplayTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncEveryWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Append([]byte("complete"))
+	log.Append([]byte("torn"))
+	log.Close()
+
+	// Chop off the end of the last record, as a crash mid-write would.
+	path := filepath.Join(dir, fileName(1))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, info.Size()-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := replayAll(t, dir)
+	if len(records) != 1 || records[0] != "complete" {
+		t.Errorf("Expected only the complete record after replay, got %v", records)
+	}
+}
+
+func TestRotateRemove(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncEveryWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	log.Append([]byte("old"))
+	gen, err := log.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Append([]byte("new"))
+
+	records := replayAll(t, dir)
+	if len(records) != 2 {
+		t.Errorf("Expected records from both files before remove, got %v", records)
+	}
+
+	err = log.RemoveThrough(gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records = replayAll(t, dir)
+	if len(records) != 1 || records[0] != "new" {
+		t.Errorf("Expected only the new record after remove, got %v", records)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncGroupCommit, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writers, perWriter := 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				err := log.Append([]byte(fmt.Sprintf("%d-%d", w, i)))
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if log.synced != log.written {
+		t.Errorf("Expected all records synced after appends returned (synced %d, written %d)", log.synced, log.written)
+	}
+	log.Close()
+
+	records := replayAll(t, dir)
+	if len(records) != writers*perWriter {
+		t.Errorf("Got %d records (expected %d)", len(records), writers*perWriter)
+	}
+}
+
+func TestSyncEveryWriteRotate(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncEveryWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers sync on their own while the log rotates under them, so
+	// rotated files must stay open until no sync is using them.
+	writers, perWriter := 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				err := log.Append([]byte(fmt.Sprintf("%d-%d", w, i)))
+				if err != nil {
+					t.Error(err)
+				}
+				if i%10 == 0 {
+					_, err = log.Rotate()
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = log.Append([]byte("last"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.synced != log.written || len(log.retired) != 0 || log.inflight != 0 {
+		t.Errorf("Expected all records synced and rotated files closed (synced %d, written %d, retired %d)", log.synced, log.written, len(log.retired))
+	}
+	log.Close()
+
+	records := replayAll(t, dir)
+	if len(records) != writers*perWriter+1 {
+		t.Errorf("Got %d records (expected %d)", len(records), writers*perWriter+1)
+	}
+}
+
+func TestIntervalSync(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncInterval, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	log.Append([]byte("hello"))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		log.mu.Lock()
+		synced := log.synced
+		log.mu.Unlock()
+		if synced == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Record was not synced by the background interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFailedWriteRotate(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncEveryWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	log.Append([]byte("before"))
+
+	// Swap in a read-only handle, so the write fails and so does the
+	// truncate that would clean up after it.
+	writable := log.file
+	log.file, err = os.Open(writable.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writable.Close()
+
+	_, err = log.Write([]byte("failed"))
+	if err == nil {
+		t.Fatal("Expected write to a read-only file to fail")
+	}
+	_, err = log.Write([]byte("after failure"))
+	if err == nil {
+		t.Error("Expected writes to fail until the log is rotated")
+	}
+
+	_, err = log.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Append([]byte("after rotate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := replayAll(t, dir)
+	if len(records) != 2 || records[0] != "before" || records[1] != "after rotate" {
+		t.Errorf("Expected records around the failed write after replay, got %v", records)
+	}
+}
+
+func TestRotatePrepared(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open(dir, SyncEveryWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	if log.next == nil {
+		t.Fatal("Expected Open to prepare the next log file")
+	}
+	_, err = log.Write([]byte("unsynced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := log.next
+	_, err = log.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.file != next || log.next != nil {
+		t.Error("Expected Rotate to switch to the prepared file")
+	}
+
+	// The old file's record is synced along with the next write.
+	err = log.Append([]byte("synced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log.retired) != 0 || log.synced != log.written {
+		t.Errorf("Expected rotated file synced and closed (retired %d, synced %d, written %d)", len(log.retired), log.synced, log.written)
+	}
+
+	err = log.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.next == nil {
+		t.Error("Expected Prepare to create the next log file")
+	}
+	records := replayAll(t, dir)
+	if len(records) != 2 || records[0] != "unsynced" || records[1] != "synced" {
+		t.Errorf("Expected records from both files, got %v", records)
+	}
+}